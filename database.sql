@@ -1,5 +1,6 @@
 -- Drop existing tables (for dev reset)
-DROP TABLE IF EXISTS AuditLogs, Clockings, RaceResults, RaceParticipants, Races, Devices, LoftCoordinates, Pigeons, Users, Clubs CASCADE;
+DROP FUNCTION IF EXISTS pigeon_owner_at;
+DROP TABLE IF EXISTS FoundReports, PigeonStatusChanges, PigeonOwnership, PigeonTransfers, HealthRecords, NestRounds, Pairings, Notifications, LiberationReports, Penalties, ProtestEvidence, ResultRevisions, Protests, DerbyPrizes, DerbyEntries, TeamResults, TeamNominations, Sections, PoolLedger, PoolNominations, Pools, SeasonStandings, IdempotencyKeys, EventDeadLetters, EventSubscriptions, DomainEvents, AuditLogs, ClockingFindings, DeviceSyncRejections, Clockings, RaceResults, RaceParticipants, RaceSponsors, Races, Derbies, Seasons, Devices, LoftCoordinates, Pigeons, Users, Clubs CASCADE;
 
 -- ========== USERS ==========
 CREATE TABLE Users (
@@ -9,7 +10,7 @@ CREATE TABLE Users (
     full_name VARCHAR(100),
     email VARCHAR(100),
     phone_number VARCHAR(20),
-    role VARCHAR(20) DEFAULT 'racer',
+    role VARCHAR(20) DEFAULT 'racer', -- racer | convoyer | officer | admin
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -18,6 +19,9 @@ CREATE TABLE Clubs (
     club_id SERIAL PRIMARY KEY,
     name VARCHAR(100) UNIQUE NOT NULL,
     location VARCHAR(100),
+    anomaly_action VARCHAR(20) DEFAULT 'quarantine', -- reject | quarantine
+    max_speed_kph DECIMAL(10,2) DEFAULT 200,
+    required_vaccinations JSONB NOT NULL DEFAULT '["paramyxo"]', -- needed on race day to basket a bird
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -43,21 +47,187 @@ CREATE TABLE Pigeons (
     pigeon_id SERIAL PRIMARY KEY,
     user_id INT REFERENCES Users(user_id) ON DELETE CASCADE,
     ring_number VARCHAR(50) UNIQUE NOT NULL,
+    chip_number VARCHAR(50) UNIQUE, -- electronic ring read by clocking systems
     name VARCHAR(100),
     color VARCHAR(50),
     sex VARCHAR(10),
     breed VARCHAR(50),
     birth_date DATE,
+    sire_id INT REFERENCES Pigeons(pigeon_id) ON DELETE SET NULL,
+    dam_id INT REFERENCES Pigeons(pigeon_id) ON DELETE SET NULL,
+    sire_ring VARCHAR(50), -- parent known only by an external ring number
+    dam_ring VARCHAR(50),
+    nest_round_id INT, -- nest round the bird was bred in, see NestRounds
+    status VARCHAR(20) NOT NULL DEFAULT 'active', -- active | lost | found | returned | deceased
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ========== OWNERSHIP ==========
+-- Seller proposes, buyer accepts
+CREATE TABLE PigeonTransfers (
+    transfer_id SERIAL PRIMARY KEY,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
+    from_user_id INT REFERENCES Users(user_id),
+    to_user_id INT REFERENCES Users(user_id),
+    sale_price DECIMAL(10,2), -- NULL for a gift
+    notes TEXT,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending | accepted | declined | cancelled
+    initiated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    responded_at TIMESTAMP
+);
+
+-- Who owned a pigeon when; written once the bird first changes hands.
+-- owned_from NULL means since the bird was registered.
+CREATE TABLE PigeonOwnership (
+    id SERIAL PRIMARY KEY,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
+    user_id INT REFERENCES Users(user_id),
+    owned_from TIMESTAMP,
+    owned_until TIMESTAMP,
+    transfer_id INT REFERENCES PigeonTransfers(transfer_id)
+);
+
+-- Owner of a pigeon at a point in time; Pigeons.user_id when it never changed hands
+CREATE FUNCTION pigeon_owner_at(pid INT, at TIMESTAMP) RETURNS INT AS $$
+    SELECT COALESCE(
+        (SELECT o.user_id FROM PigeonOwnership o
+         WHERE o.pigeon_id = pid AND (o.owned_from IS NULL OR o.owned_from <= at)
+             AND (o.owned_until IS NULL OR o.owned_until > at)
+         ORDER BY o.owned_from DESC NULLS LAST
+         LIMIT 1),
+        (SELECT user_id FROM Pigeons WHERE pigeon_id = pid))
+$$ LANGUAGE SQL STABLE;
+
+-- ========== HEALTH ==========
+CREATE TABLE HealthRecords (
+    record_id SERIAL PRIMARY KEY,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL, -- vaccination | treatment | vet_visit
+    name VARCHAR(100) NOT NULL, -- e.g. paramyxo
+    product VARCHAR(100),
+    administered_on DATE NOT NULL,
+    expires_on DATE, -- NULL = does not expire
+    vet_name VARCHAR(100),
+    notes TEXT,
+    recorded_by INT REFERENCES Users(user_id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ========== BREEDING ==========
+CREATE TABLE Pairings (
+    pairing_id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES Users(user_id) ON DELETE CASCADE,
+    cock_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
+    hen_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
+    paired_on DATE NOT NULL,
+    ended_on DATE,
+    notes TEXT
+);
+
+CREATE TABLE NestRounds (
+    round_id SERIAL PRIMARY KEY,
+    pairing_id INT REFERENCES Pairings(pairing_id) ON DELETE CASCADE,
+    round_no INT NOT NULL,
+    laid_on DATE NOT NULL,
+    eggs_laid INT NOT NULL,
+    hatched_on DATE,
+    eggs_hatched INT NOT NULL DEFAULT 0,
+    notes TEXT,
+    UNIQUE (pairing_id, round_no)
+);
+
+ALTER TABLE Pigeons ADD FOREIGN KEY (nest_round_id) REFERENCES NestRounds(round_id) ON DELETE SET NULL;
+
+-- ========== SEASONS ==========
+CREATE TABLE Seasons (
+    season_id SERIAL PRIMARY KEY,
+    club_id INT REFERENCES Clubs(club_id),
+    name VARCHAR(100) NOT NULL,
+    start_date DATE,
+    end_date DATE,
+    points_scheme VARCHAR(20) NOT NULL DEFAULT 'table', -- table | distance | prize_ratio
+    points_table JSONB NOT NULL DEFAULT '[]', -- points per position, e.g. [100, 90, 80]
+    prize_ratio INT NOT NULL DEFAULT 0, -- prize_ratio scheme: 1 in N birds score
+    max_points DECIMAL(10,2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Per-season sections of the club territory, each with its own result
+CREATE TABLE Sections (
+    section_id SERIAL PRIMARY KEY,
+    season_id INT REFERENCES Seasons(season_id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    kind VARCHAR(10) NOT NULL, -- band | polygon
+    min_km DECIMAL(10,3) NOT NULL DEFAULT 0, -- band: loft distance in [min_km, max_km)
+    max_km DECIMAL(10,3) NOT NULL DEFAULT 0, -- 0 = no upper bound
+    polygon JSONB NOT NULL DEFAULT '[]', -- polygon: [[lat, lng], ...] over LoftCoordinates
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ========== ONE-LOFT DERBIES ==========
+CREATE TABLE Derbies (
+    derby_id SERIAL PRIMARY KEY,
+    club_id INT REFERENCES Clubs(club_id),
+    name VARCHAR(100) NOT NULL,
+    entry_fee DECIMAL(10,2) NOT NULL DEFAULT 0, -- per bird
+    prize_fund_pct DECIMAL(5,2) NOT NULL DEFAULT 0, -- share of entry fees paid as prizes
+    hotspot_pct DECIMAL(5,2) NOT NULL DEFAULT 0, -- share of the prize fund paid on hot spots
+    hotspot_places INT NOT NULL DEFAULT 1, -- paid places per hot spot
+    final_split JSONB NOT NULL DEFAULT '[]', -- % of the final prize money per position
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 -- ========== RACES ==========
 CREATE TABLE Races (
     race_id SERIAL PRIMARY KEY,
+    club_id INT REFERENCES Clubs(club_id),
+    season_id INT REFERENCES Seasons(season_id),
+    derby_id INT REFERENCES Derbies(derby_id),
+    race_type VARCHAR(20) NOT NULL DEFAULT 'standard', -- standard | hotspot | derby_final
     name VARCHAR(100) NOT NULL,
     location VARCHAR(100),
     distance_km DECIMAL(10, 2),
+    release_lat DECIMAL(9,6),
+    release_lng DECIMAL(9,6),
+    release_time TIMESTAMP NOT NULL, -- actual release once liberated, used for flying times
+    scheduled_release_time TIMESTAMP, -- release time planned when the race was created
+    liberated_at TIMESTAMP, -- when the liberation report came in
+    weather VARCHAR(100),
+    flying_window VARCHAR(10) NOT NULL DEFAULT 'none', -- none | fixed | sun
+    day_start TIME, -- fixed window: hours outside day_start..day_end are neutralized
+    day_end TIME,
+    close_time TIMESTAMP, -- birds clocked later are outside the race
+    prize_ratio INT NOT NULL DEFAULT 0, -- 1 in N basketed birds win a prize, 0 = no prizes
+    entry_fee DECIMAL(10,2) NOT NULL DEFAULT 0, -- per basketed bird
+    deduction_pct DECIMAL(5,2) NOT NULL DEFAULT 0, -- club share of the prize pool
+    prize_split JSONB NOT NULL DEFAULT '[]', -- optional % of the pool per position, e.g. [30, 20, 15]
+    team_size INT NOT NULL DEFAULT 0, -- nominated birds scored per loft team, 0 = no team result
+    team_scoring VARCHAR(20) NOT NULL DEFAULT 'positions', -- positions | avg_speed
+    status VARCHAR(20) NOT NULL DEFAULT 'scheduled', -- scheduled | postponed | released | cancelled
+    status_reason TEXT, -- why the race was last cancelled, postponed or re-released
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Convoyer's report of the actual release; the latest report is in force
+CREATE TABLE LiberationReports (
+    report_id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    convoyer_id INT REFERENCES Users(user_id),
     release_time TIMESTAMP NOT NULL,
+    weather VARCHAR(100),
+    wind_direction VARCHAR(10), -- e.g. NE
+    wind_speed_kph DECIMAL(6,2),
+    crate_count INT NOT NULL,
+    remarks TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Sponsor money added to a race's prize pool
+CREATE TABLE RaceSponsors (
+    id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    sponsor_name VARCHAR(100) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -67,9 +237,24 @@ CREATE TABLE RaceParticipants (
     race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
     pigeon_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
     registered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    status VARCHAR(20) NOT NULL DEFAULT 'entered', -- entered | carried_over | refunded
+    carried_to_race_id INT REFERENCES Races(race_id),
+    refund_amount DECIMAL(10,2),
+    refunded_at TIMESTAMP,
     UNIQUE (race_id, pigeon_id)
 );
 
+-- Birds entered in a derby, owned by different fanciers but housed at the central loft
+CREATE TABLE DerbyEntries (
+    id SERIAL PRIMARY KEY,
+    derby_id INT REFERENCES Derbies(derby_id) ON DELETE CASCADE,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id),
+    user_id INT REFERENCES Users(user_id), -- owner at entry
+    fee_paid DECIMAL(10,2) NOT NULL DEFAULT 0,
+    entered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (derby_id, pigeon_id)
+);
+
 -- ========== CLOCKINGS ==========
 CREATE TABLE Clockings (
     clocking_id SERIAL PRIMARY KEY,
@@ -77,9 +262,38 @@ CREATE TABLE Clockings (
     race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
     user_id INT REFERENCES Users(user_id) ON DELETE CASCADE,
     device_id INT,
+    device_seq BIGINT, -- device's own counter for offline sync, NULL for manual entries
     arrival_time TIMESTAMP NOT NULL,
     speed_kph DECIMAL(10,2),
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    status VARCHAR(20) NOT NULL DEFAULT 'accepted', -- accepted | quarantined | rejected | unverified | invalidated
+    source VARCHAR(10) NOT NULL DEFAULT 'device', -- device | manual
+    reported_by VARCHAR(100), -- manual clockings: who reported the arrival
+    verification_code VARCHAR(50),
+    photo_ref TEXT,
+    reviewed_by INT REFERENCES Users(user_id),
+    reviewed_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (device_id, device_seq)
+);
+
+-- Device sequences refused for good (bad data, unknown or cancelled race), so
+-- the device's sync cursor can move past them
+CREATE TABLE DeviceSyncRejections (
+    device_id INT REFERENCES Devices(device_id) ON DELETE CASCADE,
+    device_seq BIGINT NOT NULL,
+    error TEXT NOT NULL,
+    rejected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (device_id, device_seq)
+);
+
+-- Anomalies detected by the clocking rules
+CREATE TABLE ClockingFindings (
+    finding_id SERIAL PRIMARY KEY,
+    clocking_id INT REFERENCES Clockings(clocking_id) ON DELETE CASCADE,
+    rule VARCHAR(50) NOT NULL,
+    detail TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (clocking_id, rule)
 );
 
 -- ========== RACE RESULTS ==========
@@ -87,9 +301,187 @@ CREATE TABLE RaceResults (
     id SERIAL PRIMARY KEY,
     race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
     pigeon_id INT REFERENCES Pigeons(pigeon_id),
+    user_id INT REFERENCES Users(user_id), -- owner of the bird at release
+    distance_km DECIMAL(10,3), -- loft distance from the release point
     speed_kph DECIMAL(10,2),
     arrival_time TIMESTAMP,
-    rank INT
+    rank INT,
+    outside_race BOOLEAN NOT NULL DEFAULT FALSE,
+    prize BOOLEAN NOT NULL DEFAULT FALSE,
+    prize_amount DECIMAL(10,2) NOT NULL DEFAULT 0,
+    disqualified BOOLEAN NOT NULL DEFAULT FALSE,
+    penalty_minutes DECIMAL(8,2) NOT NULL DEFAULT 0,
+    penalty_points DECIMAL(10,2) NOT NULL DEFAULT 0, -- bird penalties
+    loft_penalty_points DECIMAL(10,2) NOT NULL DEFAULT 0, -- loft penalties, on the loft's best ranked line
+    penalty_codes TEXT NOT NULL DEFAULT '', -- comma separated reason codes
+    UNIQUE (race_id, pigeon_id)
+);
+
+-- Penalties on one race entry (pigeon_id) or a whole loft (user_id)
+CREATE TABLE Penalties (
+    penalty_id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id),
+    user_id INT REFERENCES Users(user_id),
+    reason_code VARCHAR(30) NOT NULL, -- late_basketing | wrong_ring | failed_inspection | ...
+    kind VARCHAR(20) NOT NULL, -- disqualification | time | points
+    minutes DECIMAL(8,2) NOT NULL DEFAULT 0,
+    points DECIMAL(10,2) NOT NULL DEFAULT 0,
+    note TEXT,
+    issued_by INT REFERENCES Users(user_id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((pigeon_id IS NULL) <> (user_id IS NULL))
+);
+
+-- Every computation or correction of a race's results, numbered per race.
+-- RaceResults holds a copy of the published (official) revision.
+CREATE TABLE ResultRevisions (
+    revision_id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    revision_no INT NOT NULL,
+    reason TEXT NOT NULL,
+    created_by INT REFERENCES Users(user_id),
+    protest_id INT, -- set when an upheld protest caused the recomputation
+    results JSONB NOT NULL,
+    teams JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    official BOOLEAN NOT NULL DEFAULT FALSE, -- the published revision, copied to RaceResults
+    published_by INT REFERENCES Users(user_id),
+    published_at TIMESTAMP,
+    UNIQUE (race_id, revision_no)
+);
+
+-- ========== PROTESTS ==========
+CREATE TABLE Protests (
+    protest_id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    clocking_id INT REFERENCES Clockings(clocking_id) ON DELETE SET NULL, -- NULL = against the whole race
+    filed_by INT REFERENCES Users(user_id),
+    grounds TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open', -- open | upheld | dismissed
+    decided_by INT REFERENCES Users(user_id),
+    decision_note TEXT,
+    decided_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE ResultRevisions ADD FOREIGN KEY (protest_id) REFERENCES Protests(protest_id) ON DELETE SET NULL;
+
+CREATE TABLE ProtestEvidence (
+    evidence_id SERIAL PRIMARY KEY,
+    protest_id INT REFERENCES Protests(protest_id) ON DELETE CASCADE,
+    kind VARCHAR(20) NOT NULL, -- photo | document | video | statement
+    reference TEXT NOT NULL, -- URL or storage key of the file
+    description TEXT,
+    added_by INT REFERENCES Users(user_id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Championship tables, rebuilt when a race's results become official
+CREATE TABLE SeasonStandings (
+    id SERIAL PRIMARY KEY,
+    season_id INT REFERENCES Seasons(season_id) ON DELETE CASCADE,
+    category VARCHAR(20) NOT NULL, -- loft | fancier | ace_pigeon
+    subject_id INT NOT NULL, -- loft_id, user_id or pigeon_id
+    name VARCHAR(100),
+    points DECIMAL(12,2) NOT NULL,
+    races_counted INT NOT NULL,
+    rank INT NOT NULL,
+    computed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ========== NOMINATION POOLS ==========
+CREATE TABLE Pools (
+    pool_id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    stake DECIMAL(10,2) NOT NULL, -- per nominated bird
+    max_nominations INT NOT NULL, -- per fancier
+    payout_places INT NOT NULL,
+    payout_split JSONB NOT NULL DEFAULT '[]', -- % per place, empty = linear
+    deduction_pct DECIMAL(5,2) NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'open', -- open | settled | refunded
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    settled_at TIMESTAMP
+);
+
+CREATE TABLE PoolNominations (
+    nomination_id SERIAL PRIMARY KEY,
+    pool_id INT REFERENCES Pools(pool_id) ON DELETE CASCADE,
+    user_id INT REFERENCES Users(user_id),
+    pigeon_id INT REFERENCES Pigeons(pigeon_id),
+    stake DECIMAL(10,2) NOT NULL,
+    place INT NOT NULL DEFAULT 0,
+    payout DECIMAL(10,2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (pool_id, pigeon_id)
+);
+
+-- Money in (stakes, positive) and out (deduction, payouts and refunds, negative)
+CREATE TABLE PoolLedger (
+    entry_id SERIAL PRIMARY KEY,
+    pool_id INT REFERENCES Pools(pool_id) ON DELETE CASCADE,
+    user_id INT REFERENCES Users(user_id),
+    pigeon_id INT REFERENCES Pigeons(pigeon_id),
+    kind VARCHAR(20) NOT NULL, -- stake | deduction | payout | refund
+    amount DECIMAL(10,2) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ========== TEAMS ==========
+-- Birds a fancier nominates, in order, for the loft team of a race
+CREATE TABLE TeamNominations (
+    id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    user_id INT REFERENCES Users(user_id),
+    pigeon_id INT REFERENCES Pigeons(pigeon_id),
+    nomination_order INT NOT NULL,
+    UNIQUE (race_id, pigeon_id)
+);
+
+CREATE TABLE TeamResults (
+    id SERIAL PRIMARY KEY,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    user_id INT REFERENCES Users(user_id),
+    loft_id INT REFERENCES LoftCoordinates(loft_id),
+    rank INT NOT NULL,
+    score DECIMAL(10,2) NOT NULL,
+    birds_scored INT NOT NULL
+);
+
+CREATE TABLE DerbyPrizes (
+    id SERIAL PRIMARY KEY,
+    derby_id INT REFERENCES Derbies(derby_id) ON DELETE CASCADE,
+    race_id INT REFERENCES Races(race_id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id),
+    user_id INT REFERENCES Users(user_id),
+    amount DECIMAL(10,2) NOT NULL
+);
+
+-- ========== LOST AND FOUND ==========
+CREATE TABLE PigeonStatusChanges (
+    change_id SERIAL PRIMARY KEY,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL,
+    race_id INT REFERENCES Races(race_id) ON DELETE SET NULL, -- race the bird went missing from
+    changed_by INT REFERENCES Users(user_id), -- NULL for a public found report
+    notes TEXT,
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Reports from the public; only the owner sees the finder's contact details
+CREATE TABLE FoundReports (
+    report_id SERIAL PRIMARY KEY,
+    pigeon_id INT REFERENCES Pigeons(pigeon_id) ON DELETE CASCADE,
+    ring_number VARCHAR(50) NOT NULL, -- as entered by the finder
+    finder_name VARCHAR(100) NOT NULL,
+    finder_contact VARCHAR(150) NOT NULL,
+    location TEXT,
+    latitude DECIMAL(9,6),
+    longitude DECIMAL(9,6),
+    message TEXT,
+    reported_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
 -- ========== AUDIT LOGS ==========
@@ -100,6 +492,60 @@ CREATE TABLE AuditLogs (
     log_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- In-app messages to users
+CREATE TABLE Notifications (
+    notification_id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES Users(user_id) ON DELETE CASCADE,
+    subject VARCHAR(200) NOT NULL,
+    body TEXT NOT NULL,
+    read_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ========== DOMAIN EVENTS (outbox) ==========
+CREATE TABLE DomainEvents (
+    event_id BIGSERIAL PRIMARY KEY,
+    txid XID8 NOT NULL DEFAULT pg_current_xact_id(), -- publishing transaction
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_domain_events_txid ON DomainEvents (txid, event_id);
+
+-- Last outbox event each named subscriber has processed, in (txid, event_id) order
+CREATE TABLE EventSubscriptions (
+    name VARCHAR(100) PRIMARY KEY,
+    last_txid XID8 NOT NULL DEFAULT '0',
+    last_event_id BIGINT NOT NULL DEFAULT 0,
+    attempts INT NOT NULL DEFAULT 0, -- failed deliveries of the next event
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Events a subscriber gave up on after repeated handler failures
+CREATE TABLE EventDeadLetters (
+    id BIGSERIAL PRIMARY KEY,
+    subscriber VARCHAR(100) NOT NULL,
+    event_id BIGINT REFERENCES DomainEvents(event_id) ON DELETE CASCADE,
+    error TEXT,
+    failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- ========== IDEMPOTENCY KEYS ==========
+-- status_code stays NULL while the first request is still being handled
+-- caller is a hash of the Authorization header, or the client IP without one
+CREATE TABLE IdempotencyKeys (
+    caller VARCHAR(64) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash CHAR(64) NOT NULL,
+    status_code INT,
+    content_type VARCHAR(100) NOT NULL DEFAULT '',
+    response_body BYTEA,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (caller, idempotency_key)
+);
+CREATE INDEX idx_idempotency_keys_created ON IdempotencyKeys (created_at);
+
 -- ========== SEED DATA ==========
 
 -- Clubs
@@ -131,11 +577,18 @@ VALUES
 (1, 'PH2024-002', 'Shadow', 'Black', 'Female', 'German', '2024-02-10'),
 (2, 'PH2024-003', 'Windchaser', 'White', 'Male', 'Dutch', '2024-03-15');
 
+-- Paramyxo vaccinations, required for basketing
+INSERT INTO HealthRecords (pigeon_id, kind, name, administered_on, expires_on)
+VALUES
+(1, 'vaccination', 'paramyxo', '2025-03-01', '2026-03-01'),
+(2, 'vaccination', 'paramyxo', '2025-03-01', '2026-03-01'),
+(3, 'vaccination', 'paramyxo', '2025-03-15', '2026-03-15');
+
 -- Races
-INSERT INTO Races (name, location, distance_km, release_time)
+INSERT INTO Races (club_id, name, location, distance_km, release_time, scheduled_release_time)
 VALUES
-('Opening Race', 'Bulacan', 50.0, '2025-06-10 06:00:00'),
-('Speed Derby', 'Pampanga', 100.0, '2025-06-12 06:00:00');
+(1, 'Opening Race', 'Bulacan', 50.0, '2025-06-10 06:00:00', '2025-06-10 06:00:00'),
+(1, 'Speed Derby', 'Pampanga', 100.0, '2025-06-12 06:00:00', '2025-06-12 06:00:00');
 
 -- Participants
 INSERT INTO RaceParticipants (race_id, pigeon_id) VALUES
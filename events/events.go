@@ -0,0 +1,109 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Channel is the Postgres NOTIFY channel every domain event is announced on.
+const Channel = "domain_events"
+
+// Event types
+const (
+	UserRegistered   = "UserRegistered"
+	RaceCreated      = "RaceCreated"
+	EntryAdded       = "EntryAdded"
+	ClockingRecorded = "ClockingRecorded"
+	ResultsOfficial  = "ResultsOfficial"
+	RaceLiberated    = "RaceLiberated"
+	RaceCancelled    = "RaceCancelled"
+)
+
+// Event is one row of the DomainEvents outbox.
+type Event struct {
+	EventID   int64           `json:"event_id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type UserRegisteredPayload struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type RaceCreatedPayload struct {
+	RaceID      int     `json:"race_id"`
+	Name        string  `json:"name"`
+	DistanceKM  float64 `json:"distance_km"`
+	ReleaseTime string  `json:"release_time"`
+}
+
+type EntryAddedPayload struct {
+	RaceID   int `json:"race_id"`
+	PigeonID int `json:"pigeon_id"`
+}
+
+type ClockingRecordedPayload struct {
+	ClockingID int     `json:"clocking_id"`
+	PigeonID   int     `json:"pigeon_id"`
+	RaceID     int     `json:"race_id"`
+	UserID     int     `json:"user_id"`
+	DeviceID   int     `json:"device_id"`
+	Arrival    string  `json:"arrival_time"`
+	SpeedKPH   float64 `json:"speed_kph"`
+	Status     string  `json:"status"`
+}
+
+type ResultsOfficialPayload struct {
+	RaceID     int `json:"race_id"`
+	RevisionNo int `json:"revision_no"`
+}
+
+type RaceLiberatedPayload struct {
+	RaceID           int     `json:"race_id"`
+	ScheduledRelease string  `json:"scheduled_release"`
+	ActualRelease    string  `json:"actual_release"`
+	DelayMinutes     float64 `json:"delay_minutes"`
+	Weather          string  `json:"weather"`
+}
+
+type RaceCancelledPayload struct {
+	RaceID int    `json:"race_id"`
+	Reason string `json:"reason"`
+}
+
+// Execer is satisfied by both *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Publish writes the event to the outbox and announces it with pg_notify.
+// When ex is a transaction the notification is only delivered on commit, so
+// subscribers never see an event whose data was rolled back.
+func Publish(ex Execer, eventType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var eventID int64
+	err = ex.QueryRow(`
+		INSERT INTO DomainEvents (event_type, payload)
+		VALUES ($1, $2)
+		RETURNING event_id
+	`, eventType, body).Scan(&eventID)
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.Exec(`SELECT pg_notify($1, $2::text)`, Channel, eventID)
+	return err
+}
+
+// Decode unmarshals the event payload into v.
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
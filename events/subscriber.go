@@ -0,0 +1,207 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Handler processes one event. Returning an error stops the catch-up pass;
+// the event is retried on the next notification or reconnect, and after
+// MaxAttempts failures it is moved to EventDeadLetters and skipped.
+type Handler func(Event) error
+
+// MaxAttempts is how often a failing event is retried before it is dead-lettered.
+const MaxAttempts = 5
+
+// Subscriber listens on the domain event channel and delivers every outbox
+// event to its handlers in commit-safe (txid, event_id) order. Its position is stored in
+// EventSubscriptions under Name, so events published while it was offline
+// (or while the listener connection was down) are replayed from the outbox.
+type Subscriber struct {
+	Name     string
+	connStr  string
+	db       *sql.DB
+	handlers map[string][]Handler
+	all      []Handler
+}
+
+func NewSubscriber(connStr string, db *sql.DB, name string) *Subscriber {
+	return &Subscriber{
+		Name:     name,
+		connStr:  connStr,
+		db:       db,
+		handlers: map[string][]Handler{},
+	}
+}
+
+// On registers a handler for one event type.
+func (s *Subscriber) On(eventType string, h Handler) {
+	s.handlers[eventType] = append(s.handlers[eventType], h)
+}
+
+// OnAll registers a handler for every event type.
+func (s *Subscriber) OnAll(h Handler) {
+	s.all = append(s.all, h)
+}
+
+// Run blocks until ctx is cancelled. pq.Listener reconnects on its own; a nil
+// notification signals a reconnect, after which the outbox is replayed.
+func (s *Subscriber) Run(ctx context.Context) error {
+	if _, err := s.db.Exec(`
+		INSERT INTO EventSubscriptions (name, last_event_id)
+		VALUES ($1, 0)
+		ON CONFLICT (name) DO NOTHING
+	`, s.Name); err != nil {
+		return err
+	}
+
+	listener := pq.NewListener(s.connStr, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("⚠️ Event listener %s: %v\n", s.Name, err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(Channel); err != nil {
+		return err
+	}
+
+	// Pick up anything published before we started listening.
+	s.catchUp()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-listener.Notify:
+			// Both a real notification and a reconnect (nil) mean "read the outbox".
+			s.catchUp()
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+			s.catchUp()
+		}
+	}
+}
+
+// catchUp delivers the outbox events the subscriber has not handled yet.
+//
+// event_id is allocated before commit, so a transaction holding a lower id
+// can commit after a higher one has been handled. Events are therefore only
+// read from transactions older than the oldest one still running (the
+// snapshot xmin) and taken in (txid, event_id) order: nothing can later
+// appear behind the stored position. The subscription row stays locked for
+// the whole pass, so instances sharing a name never dispatch the same event.
+func (s *Subscriber) catchUp() {
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("❌ Event subscriber %s: begin: %v\n", s.Name, err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Read before taking the row lock, which gives this transaction an xid
+	// of its own.
+	var horizon string
+	if err := tx.QueryRow(`SELECT pg_snapshot_xmin(pg_current_snapshot())::text`).Scan(&horizon); err != nil {
+		log.Printf("❌ Event subscriber %s: load snapshot: %v\n", s.Name, err)
+		return
+	}
+
+	var lastTxID string
+	var lastID int64
+	var attempts int
+	err = tx.QueryRow(`
+		SELECT last_txid::text, last_event_id, attempts FROM EventSubscriptions
+		WHERE name = $1
+		FOR UPDATE SKIP LOCKED
+	`, s.Name).Scan(&lastTxID, &lastID, &attempts)
+	if err == sql.ErrNoRows {
+		return // another instance is catching up
+	}
+	if err != nil {
+		log.Printf("❌ Event subscriber %s: load position: %v\n", s.Name, err)
+		return
+	}
+
+	rows, err := tx.Query(`
+		SELECT event_id, txid::text, event_type, payload, created_at
+		FROM DomainEvents
+		WHERE (txid, event_id) > ($1::xid8, $2) AND txid < $3::xid8
+		ORDER BY txid, event_id
+	`, lastTxID, lastID, horizon)
+	if err != nil {
+		log.Printf("❌ Event subscriber %s: load events: %v\n", s.Name, err)
+		return
+	}
+	type pendingEvent struct {
+		Event
+		txid string
+	}
+	var pending []pendingEvent
+	for rows.Next() {
+		var e pendingEvent
+		if err := rows.Scan(&e.EventID, &e.txid, &e.Type, &e.Payload, &e.CreatedAt); err != nil {
+			rows.Close()
+			log.Printf("❌ Event subscriber %s: scan event: %v\n", s.Name, err)
+			return
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("❌ Event subscriber %s: load events: %v\n", s.Name, err)
+		return
+	}
+
+	for _, e := range pending {
+		if err := s.dispatch(e.Event); err != nil {
+			attempts++
+			log.Printf("❌ Event subscriber %s: event %d (%s), attempt %d: %v\n", s.Name, e.EventID, e.Type, attempts, err)
+			if attempts < MaxAttempts {
+				if _, err := tx.Exec(`UPDATE EventSubscriptions SET attempts = $1, updated_at = NOW() WHERE name = $2`, attempts, s.Name); err != nil {
+					log.Printf("❌ Event subscriber %s: save attempts: %v\n", s.Name, err)
+					return
+				}
+				break
+			}
+			// A poison event is parked so the events behind it still flow.
+			_, dlErr := tx.Exec(`INSERT INTO EventDeadLetters (subscriber, event_id, error) VALUES ($1, $2, $3)`,
+				s.Name, e.EventID, err.Error())
+			if dlErr != nil {
+				log.Printf("❌ Event subscriber %s: dead-letter event %d: %v\n", s.Name, e.EventID, dlErr)
+				return
+			}
+			log.Printf("⚠️ Event subscriber %s: event %d dead-lettered after %d attempts\n", s.Name, e.EventID, attempts)
+		}
+		attempts = 0
+		_, err := tx.Exec(`
+			UPDATE EventSubscriptions SET last_txid = $1::xid8, last_event_id = $2, attempts = 0, updated_at = NOW()
+			WHERE name = $3`, e.txid, e.EventID, s.Name)
+		if err != nil {
+			log.Printf("❌ Event subscriber %s: save position: %v\n", s.Name, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("❌ Event subscriber %s: save position: %v\n", s.Name, err)
+	}
+}
+
+func (s *Subscriber) dispatch(e Event) error {
+	for _, h := range s.all {
+		if err := h(e); err != nil {
+			return err
+		}
+	}
+	for _, h := range s.handlers[e.Type] {
+		if err := h(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
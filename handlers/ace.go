@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// AcePlacing is one race counted toward a bird's ace coefficient.
+type AcePlacing struct {
+	RaceID      int     `json:"race_id"`
+	RaceName    string  `json:"race_name"`
+	Rank        int     `json:"rank"`
+	Entered     int     `json:"entered"`
+	DistanceKM  float64 `json:"distance_km"`
+	Coefficient float64 `json:"coefficient"`
+}
+
+// AceEntry is one bird in the ace pigeon ranking. A lower coefficient is better.
+type AceEntry struct {
+	Rank            int          `json:"rank"`
+	PigeonID        int          `json:"pigeon_id"`
+	RingNumber      string       `json:"ring_number"`
+	Fancier         string       `json:"fancier"`
+	Races           int          `json:"races"` // classified races; the best MinRaces are scored
+	TotalDistanceKM float64      `json:"total_distance_km"`
+	Coefficient     float64      `json:"coefficient"`
+	Placings        []AcePlacing `json:"placings"` // the scored placings
+}
+
+// aceQuery selects the races and qualification rules of an ace ranking.
+type aceQuery struct {
+	RaceIDs       []int
+	SeasonID      int
+	MinRaces      int     // a bird must be classified in at least this many races
+	MinDistanceKM float64 // races shorter than this do not count
+}
+
+// parseAceQuery reads ?races=1,2,3 or ?season_id=N plus min_races and min_distance.
+func parseAceQuery(c *fiber.Ctx) (aceQuery, error) {
+	q := aceQuery{
+		SeasonID:      c.QueryInt("season_id"),
+		MinRaces:      c.QueryInt("min_races", 1),
+		MinDistanceKM: c.QueryFloat("min_distance"),
+	}
+	if q.MinRaces < 1 {
+		return q, errors.New("min_races must be at least 1")
+	}
+	if races := c.Query("races"); races != "" {
+		for _, part := range strings.Split(races, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return q, errors.New("races must be a comma separated list of race ids")
+			}
+			q.RaceIDs = append(q.RaceIDs, id)
+		}
+	}
+	if len(q.RaceIDs) == 0 && q.SeasonID == 0 {
+		return q, errors.New("races or season_id is required")
+	}
+	return q, nil
+}
+
+// computeAceRanking scores each placing as rank / birds entered × 1000 and
+// ranks birds on the sum of their best MinRaces placings. Birds classified in
+// fewer than MinRaces races are left out.
+func computeAceRanking(db *sql.DB, q aceQuery) ([]AceEntry, error) {
+	rows, err := db.Query(`
+		SELECT rr.race_id, r.name, rr.rank, COALESCE(r.distance_km, 0),
+			(SELECT COUNT(*) FROM RaceParticipants rp WHERE rp.race_id = rr.race_id AND rp.status = 'entered'),
+			p.pigeon_id, p.ring_number, COALESCE(u.full_name, u.username)
+		FROM RaceResults rr
+		JOIN Races r ON r.race_id = rr.race_id
+		JOIN Pigeons p ON p.pigeon_id = rr.pigeon_id
+		JOIN Users u ON u.user_id = COALESCE(rr.user_id, p.user_id)
+		WHERE rr.rank IS NOT NULL AND r.status <> 'cancelled'
+			AND (r.race_id = ANY($1) OR r.season_id = $2)
+			AND COALESCE(r.distance_km, 0) >= $3
+		ORDER BY rr.race_id, rr.rank
+	`, pq.Array(q.RaceIDs), q.SeasonID, q.MinDistanceKM)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	birds := map[int]*AceEntry{}
+	for rows.Next() {
+		var pl AcePlacing
+		var pigeonID int
+		var ring, fancier string
+		if err := rows.Scan(&pl.RaceID, &pl.RaceName, &pl.Rank, &pl.DistanceKM, &pl.Entered, &pigeonID, &ring, &fancier); err != nil {
+			return nil, err
+		}
+		if pl.Entered == 0 {
+			continue
+		}
+		pl.Coefficient = float64(pl.Rank) / float64(pl.Entered) * 1000
+
+		e, ok := birds[pigeonID]
+		if !ok {
+			e = &AceEntry{PigeonID: pigeonID, RingNumber: ring, Fancier: fancier}
+			birds[pigeonID] = e
+		}
+		e.Placings = append(e.Placings, pl)
+		e.Races++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Every bird is scored on the same number of races, its best MinRaces,
+	// so flying more races never counts against it.
+	ranking := []AceEntry{}
+	for _, e := range birds {
+		if e.Races < q.MinRaces {
+			continue
+		}
+		sort.SliceStable(e.Placings, func(i, j int) bool { return e.Placings[i].Coefficient < e.Placings[j].Coefficient })
+		e.Placings = e.Placings[:q.MinRaces]
+		for _, pl := range e.Placings {
+			e.TotalDistanceKM += pl.DistanceKM
+			e.Coefficient += pl.Coefficient
+		}
+		ranking = append(ranking, *e)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].Coefficient != ranking[j].Coefficient {
+			return ranking[i].Coefficient < ranking[j].Coefficient
+		}
+		return ranking[i].PigeonID < ranking[j].PigeonID
+	})
+	for i := range ranking {
+		ranking[i].Rank = i + 1
+	}
+	return ranking, nil
+}
+
+// GetAcePigeonsHandler returns the ace pigeon ranking as JSON.
+func GetAcePigeonsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		q, err := parseAceQuery(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		ranking, err := computeAceRanking(db, q)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(ranking)
+	}
+}
+
+// AcePigeonReportPage renders the ace pigeon ranking as a printable page.
+func AcePigeonReportPage(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		q, err := parseAceQuery(c)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		ranking, err := computeAceRanking(db, q)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Render("ace_report", fiber.Map{
+			"Ranking":       ranking,
+			"MinRaces":      q.MinRaces,
+			"MinDistanceKM": q.MinDistanceKM,
+		})
+	}
+}
@@ -2,7 +2,11 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"hvm_clocking/events"
 	"net/http"
+	"sort"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -11,15 +15,34 @@ import (
 func CreateClubHandler(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var club struct {
-			Name     string `json:"name"`
-			Location string `json:"location"`
+			Name          string  `json:"name"`
+			Location      string  `json:"location"`
+			AnomalyAction string  `json:"anomaly_action"` // reject | quarantine
+			MaxSpeedKPH   float64 `json:"max_speed_kph"`
+			// Vaccinations a bird must hold on race day; nil means paramyxo only
+			RequiredVaccinations []string `json:"required_vaccinations"`
 		}
 
 		if err := c.BodyParser(&club); err != nil {
 			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
 		}
+		if club.AnomalyAction == "" {
+			club.AnomalyAction = "quarantine"
+		}
+		if club.AnomalyAction != "quarantine" && club.AnomalyAction != "reject" {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{"error": "anomaly_action must be quarantine or reject"})
+		}
+		if club.MaxSpeedKPH == 0 {
+			club.MaxSpeedKPH = 200
+		}
 
-		_, err := db.Exec(`INSERT INTO Clubs (name, location) VALUES ($1, $2)`, club.Name, club.Location)
+		if club.RequiredVaccinations == nil {
+			club.RequiredVaccinations = []string{"paramyxo"}
+		}
+		vaccinations, _ := json.Marshal(club.RequiredVaccinations)
+
+		_, err := db.Exec(`INSERT INTO Clubs (name, location, anomaly_action, max_speed_kph, required_vaccinations) VALUES ($1, $2, $3, $4, $5)`,
+			club.Name, club.Location, club.AnomalyAction, club.MaxSpeedKPH, vaccinations)
 		if err != nil {
 			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -100,6 +123,7 @@ func CreatePigeonHandler(db *sql.DB) fiber.Handler {
 		var p struct {
 			UserID     int    `json:"user_id"`
 			RingNumber string `json:"ring_number"`
+			ChipNumber string `json:"chip_number"`
 			Name       string `json:"name"`
 			Color      string `json:"color"`
 			Sex        string `json:"sex"`
@@ -110,9 +134,9 @@ func CreatePigeonHandler(db *sql.DB) fiber.Handler {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
 		}
 		_, err := db.Exec(`
-			INSERT INTO Pigeons (user_id, ring_number, name, color, sex, breed, birth_date)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
-			p.UserID, p.RingNumber, p.Name, p.Color, p.Sex, p.Breed, p.BirthDate)
+			INSERT INTO Pigeons (user_id, ring_number, chip_number, name, color, sex, breed, birth_date)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			p.UserID, p.RingNumber, nullIfEmpty(p.ChipNumber), p.Name, p.Color, p.Sex, p.Breed, p.BirthDate)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
@@ -124,20 +148,120 @@ func CreatePigeonHandler(db *sql.DB) fiber.Handler {
 func CreateRaceHandler(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var r struct {
-			Name        string  `json:"name"`
-			Location    string  `json:"location"`
-			DistanceKM  float64 `json:"distance_km"`
-			ReleaseTime string  `json:"release_time"` // Format: YYYY-MM-DD HH:MM:SS
+			ClubID       *int      `json:"club_id"`
+			SeasonID     *int      `json:"season_id"`
+			DerbyID      *int      `json:"derby_id"`
+			RaceType     string    `json:"race_type"` // standard | hotspot | derby_final
+			Name         string    `json:"name"`
+			Location     string    `json:"location"`
+			DistanceKM   float64   `json:"distance_km"`
+			ReleaseLat   *float64  `json:"release_lat"`
+			ReleaseLng   *float64  `json:"release_lng"`
+			ReleaseTime  string    `json:"release_time"` // Format: YYYY-MM-DD HH:MM:SS
+			Weather      string    `json:"weather"`
+			FlyingWindow string    `json:"flying_window"` // none | fixed | sun
+			DayStart     string    `json:"day_start"`     // HH:MM, fixed window
+			DayEnd       string    `json:"day_end"`       // HH:MM, fixed window
+			CloseTime    string    `json:"close_time"`    // Format: YYYY-MM-DD HH:MM:SS
+			PrizeRatio   int       `json:"prize_ratio"`   // 1 in N birds win a prize
+			EntryFee     float64   `json:"entry_fee"`     // per basketed bird
+			DeductionPct float64   `json:"deduction_pct"` // club share of the prize pool
+			PrizeSplit   []float64 `json:"prize_split"`   // optional % of the pool per position
+			TeamSize     int       `json:"team_size"`     // nominated birds scored per loft, 0 = no teams
+			TeamScoring  string    `json:"team_scoring"`  // positions | avg_speed
 		}
 		if err := c.BodyParser(&r); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
 		}
-		_, err := db.Exec(`INSERT INTO Races (name, location, distance_km, release_time) VALUES ($1, $2, $3, $4)`,
-			r.Name, r.Location, r.DistanceKM, r.ReleaseTime)
+		switch r.FlyingWindow {
+		case "":
+			r.FlyingWindow = WindowNone
+		case WindowNone:
+		case WindowFixed:
+			start, errStart := parseClockTime(r.DayStart)
+			end, errEnd := parseClockTime(r.DayEnd)
+			if errStart != nil || errEnd != nil || end <= start {
+				return c.Status(400).JSON(fiber.Map{"error": "fixed flying window needs day_start before day_end (HH:MM)"})
+			}
+		case WindowSun:
+			if r.ReleaseLat == nil || r.ReleaseLng == nil {
+				return c.Status(400).JSON(fiber.Map{"error": "sun flying window needs release_lat and release_lng"})
+			}
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "flying_window must be none, fixed or sun"})
+		}
+		if r.PrizeRatio < 0 || r.EntryFee < 0 || r.DeductionPct < 0 || r.DeductionPct > 100 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid prize settings"})
+		}
+		switch {
+		case r.RaceType == "" && r.DerbyID != nil:
+			r.RaceType = RaceDerbyFinal
+		case r.RaceType == "":
+			r.RaceType = RaceStandard
+		}
+		if (r.RaceType == RaceStandard) != (r.DerbyID == nil) {
+			return c.Status(400).JSON(fiber.Map{"error": "hotspot and derby_final races need a derby_id; standard races must not have one"})
+		}
+		if r.RaceType != RaceStandard && r.RaceType != RaceHotSpot && r.RaceType != RaceDerbyFinal {
+			return c.Status(400).JSON(fiber.Map{"error": "race_type must be standard, hotspot or derby_final"})
+		}
+		if r.TeamScoring == "" {
+			r.TeamScoring = TeamByPositions
+		}
+		if r.TeamSize < 0 || (r.TeamScoring != TeamByPositions && r.TeamScoring != TeamByAvgSpeed) {
+			return c.Status(400).JSON(fiber.Map{"error": "team_scoring must be positions or avg_speed"})
+		}
+		if err := validatePercentages("prize_split", r.PrizeSplit); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if r.PrizeSplit == nil {
+			r.PrizeSplit = []float64{}
+		}
+		prizeSplit, _ := json.Marshal(r.PrizeSplit)
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var raceID int
+		err = tx.QueryRow(`
+			INSERT INTO Races (club_id, season_id, name, location, distance_km, release_lat, release_lng, release_time,
+				flying_window, day_start, day_end, close_time, prize_ratio, entry_fee, deduction_pct, prize_split,
+				team_size, team_scoring, derby_id, race_type, weather, scheduled_release_time)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $8)
+			RETURNING race_id`,
+			r.ClubID, r.SeasonID, r.Name, r.Location, r.DistanceKM, r.ReleaseLat, r.ReleaseLng, r.ReleaseTime,
+			r.FlyingWindow, nullIfEmpty(r.DayStart), nullIfEmpty(r.DayEnd), nullIfEmpty(r.CloseTime),
+			r.PrizeRatio, r.EntryFee, r.DeductionPct, prizeSplit, r.TeamSize, r.TeamScoring, r.DerbyID, r.RaceType, nullIfEmpty(r.Weather)).Scan(&raceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// Every derby bird that may be basketed flies every derby race.
+		resp := fiber.Map{"message": "Race created", "race_id": raceID}
+		if r.DerbyID != nil {
+			refused, err := enterDerbyBirds(tx, *r.DerbyID, raceID)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			resp["not_basketed"] = refused
+		}
+
+		err = events.Publish(tx, events.RaceCreated, events.RaceCreatedPayload{
+			RaceID:      raceID,
+			Name:        r.Name,
+			DistanceKM:  r.DistanceKM,
+			ReleaseTime: r.ReleaseTime,
+		})
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
-		return c.JSON(fiber.Map{"message": "Race created"})
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(resp)
 	}
 }
 
@@ -151,11 +275,42 @@ func RegisterPigeonToRaceHandler(db *sql.DB) fiber.Handler {
 		if err := c.BodyParser(&input); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
 		}
-		_, err := db.Exec(`INSERT INTO RaceParticipants (race_id, pigeon_id) VALUES ($1, $2)`,
-			input.RaceID, input.PigeonID)
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var status string
+		err = tx.QueryRow(`SELECT status FROM Races WHERE race_id = $1`, input.RaceID).Scan(&status)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
+		if status == RaceCancelled {
+			return c.Status(409).JSON(fiber.Map{"error": "Race is cancelled"})
+		}
+
+		entered, err := basketPigeon(tx, input.RaceID, input.PigeonID)
+		var be *basketError
+		switch {
+		case err == sql.ErrNoRows:
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		case errors.As(err, &be) && len(be.Missing) > 0:
+			return c.Status(422).JSON(fiber.Map{"error": be.Error(), "missing": be.Missing})
+		case errors.As(err, &be):
+			return c.Status(409).JSON(fiber.Map{"error": be.Error()})
+		case err != nil:
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		case !entered:
+			return c.Status(409).JSON(fiber.Map{"error": "Pigeon is already registered to this race"})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
 		return c.JSON(fiber.Map{"message": "Pigeon registered to race"})
 	}
 }
@@ -163,29 +318,49 @@ func RegisterPigeonToRaceHandler(db *sql.DB) fiber.Handler {
 // =========================== CLOCKINGS ===========================
 func ClockPigeonHandler(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		var clk struct {
-			PigeonID int     `json:"pigeon_id"`
-			RaceID   int     `json:"race_id"`
-			UserID   int     `json:"user_id"`
-			DeviceID int     `json:"device_id"`
-			Arrival  string  `json:"arrival_time"` // YYYY-MM-DD HH:MM:SS
-			SpeedKPH float64 `json:"speed_kph"`
-		}
+		var clk ClockingInput
 		if err := c.BodyParser(&clk); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
 		}
-		_, err := db.Exec(`
-			INSERT INTO Clockings (pigeon_id, race_id, user_id, device_id, arrival_time, speed_kph)
-			VALUES ($1, $2, $3, $4, $5, $6)`,
-			clk.PigeonID, clk.RaceID, clk.UserID, clk.DeviceID, clk.Arrival, clk.SpeedKPH)
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		out, err := recordClocking(tx, clk)
+		if errors.Is(err, errInvalidClocking) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
-		return c.JSON(fiber.Map{"message": "Clocking recorded"})
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		switch {
+		case out.Duplicate:
+			return c.JSON(fiber.Map{"message": "Clocking already recorded", "clocking_id": out.ClockingID, "status": out.Status})
+		case out.Status == ClockingRejected:
+			return c.Status(422).JSON(fiber.Map{"error": "Clocking rejected", "clocking_id": out.ClockingID, "findings": out.Findings})
+		case out.Status == ClockingUnverified:
+			return c.JSON(fiber.Map{"message": "Manual clocking recorded, awaiting officer verification", "clocking_id": out.ClockingID, "findings": out.Findings})
+		case out.Status == ClockingQuarantined:
+			return c.JSON(fiber.Map{"message": "Clocking quarantined for review", "clocking_id": out.ClockingID, "findings": out.Findings})
+		}
+		return c.JSON(fiber.Map{"message": "Clocking recorded", "clocking_id": out.ClockingID})
 	}
 }
 
 // =========================== RACE RESULTS ===========================
+
+// InsertRaceResultHandler records a hand correction of one bird's result. The
+// latest revision is copied with the bird's line replaced (or added), the
+// ranks renumbered and the prizes worked out again, and kept as a new
+// provisional revision; nothing public changes until it is published. The
+// bird's penalties carry over, and a disqualified bird stays unranked.
+// Only club officers may correct results.
 func InsertRaceResultHandler(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var res struct {
@@ -194,22 +369,133 @@ func InsertRaceResultHandler(db *sql.DB) fiber.Handler {
 			SpeedKPH float64 `json:"speed_kph"`
 			Arrival  string  `json:"arrival_time"` // YYYY-MM-DD HH:MM:SS
 			Rank     int     `json:"rank"`
+			UserID   int     `json:"user_id"`
+			Reason   string  `json:"reason"`
 		}
 		if err := c.BodyParser(&res); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
 		}
-		_, err := db.Exec(`
-			INSERT INTO RaceResults (race_id, pigeon_id, speed_kph, arrival_time, rank)
-			VALUES ($1, $2, $3, $4, $5)`,
-			res.RaceID, res.PigeonID, res.SpeedKPH, res.Arrival, res.Rank)
+		if res.UserID == 0 || res.Reason == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "user_id and reason are required"})
+		}
+		if res.Rank < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "rank cannot be negative"})
+		}
+		arrival, err := parseTimestamp(res.Arrival)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "arrival_time must be YYYY-MM-DD HH:MM:SS"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		ok, err := isClubOfficer(tx, res.UserID)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
-		return c.JSON(fiber.Map{"message": "Race result inserted"})
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only club officers can correct results"})
+		}
+		race, err := loadRaceInfo(tx, res.RaceID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		line := ResultLine{PigeonID: res.PigeonID, Arrival: arrival, SpeedKPH: res.SpeedKPH}
+		err = tx.QueryRow(`
+			SELECT p.ring_number, u.user_id, COALESCE(u.full_name, u.username), l.latitude, l.longitude
+			FROM Pigeons p
+			JOIN Users u ON u.user_id = pigeon_owner_at(p.pigeon_id, $2)
+			LEFT JOIN LoftCoordinates l ON l.user_id = u.user_id
+			WHERE p.pigeon_id = $1`, res.PigeonID, race.ReleaseTime).
+			Scan(&line.RingNumber, &line.UserID, &line.Fancier, &line.LoftLat, &line.LoftLng)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		line.DistanceKM = race.distanceTo(line.LoftLat, line.LoftLng)
+		line.FlyingMinutes = race.flyingTime(arrival).Minutes()
+
+		rev := ResultRevision{RaceID: res.RaceID, Reason: res.Reason, CreatedBy: &res.UserID}
+		var latest int
+		if err := tx.QueryRow(`SELECT COALESCE(MAX(revision_no), 0) FROM ResultRevisions WHERE race_id = $1`, res.RaceID).Scan(&latest); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var ranked, unranked []ResultLine
+		if latest > 0 {
+			prev, err := loadResultRevision(tx, res.RaceID, latest)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			rev.Teams = prev.Teams
+			for _, l := range prev.Results {
+				switch {
+				case l.PigeonID == res.PigeonID:
+					// Penalties already applied stay applied.
+					line.ClockingID = l.ClockingID
+					line.Disqualified, line.PenaltyMinutes = l.Disqualified, l.PenaltyMinutes
+					line.PenaltyPoints, line.LoftPenalty, line.Penalties = l.PenaltyPoints, l.LoftPenalty, l.Penalties
+				case l.Rank > 0:
+					ranked = append(ranked, l)
+				default:
+					unranked = append(unranked, l)
+				}
+			}
+		}
+
+		// The corrected bird takes the requested place; the birds from that
+		// place down move one place back.
+		sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Rank < ranked[j].Rank })
+		if res.Rank > 0 && !line.Disqualified {
+			pos := res.Rank - 1
+			if pos > len(ranked) {
+				pos = len(ranked)
+			}
+			ranked = append(ranked[:pos], append([]ResultLine{line}, ranked[pos:]...)...)
+		} else {
+			unranked = append(unranked, line)
+		}
+		for i := range ranked {
+			ranked[i].Rank = i + 1
+		}
+		rev.Results = append(ranked, unranked...)
+
+		prizes, err := computePrizeList(tx, race)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		for i := range rev.Results {
+			rev.Results[i].Prize, rev.Results[i].PrizeAmount = false, 0
+		}
+		applyPrizes(rev.Results, prizes)
+
+		rev, err = saveResultRevision(tx, rev)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Result correction saved as provisional revision", "revision_no": rev.RevisionNo})
 	}
 }
 
 // =========================== AUDIT LOGS ===========================
+
+// logAudit records an action in AuditLogs, inside the caller's transaction.
+func logAudit(q queryer, userID int, action string) error {
+	_, err := q.Exec(`INSERT INTO AuditLogs (user_id, action) VALUES ($1, $2)`, userID, action)
+	return err
+}
+
 func LogAuditActionHandler(db *sql.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var logData struct {
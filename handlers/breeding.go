@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// dateLayout is the format of calendar dates in request bodies.
+const dateLayout = "2006-01-02"
+
+// Pairing is a cock and hen put together for breeding.
+type Pairing struct {
+	PairingID int         `json:"pairing_id"`
+	UserID    int         `json:"user_id"`
+	CockID    int         `json:"cock_id"`
+	CockRing  string      `json:"cock_ring"`
+	HenID     int         `json:"hen_id"`
+	HenRing   string      `json:"hen_ring"`
+	PairedOn  string      `json:"paired_on"`
+	EndedOn   *string     `json:"ended_on"`
+	Notes     string      `json:"notes"`
+	Rounds    []NestRound `json:"rounds"`
+}
+
+// NestRound is one clutch of a pairing.
+type NestRound struct {
+	RoundID     int         `json:"round_id"`
+	PairingID   int         `json:"pairing_id"`
+	RoundNo     int         `json:"round_no"`
+	LaidOn      string      `json:"laid_on"`
+	EggsLaid    int         `json:"eggs_laid"`
+	HatchedOn   *string     `json:"hatched_on"`
+	EggsHatched int         `json:"eggs_hatched"`
+	Notes       string      `json:"notes"`
+	Youngsters  []Youngster `json:"youngsters"`
+}
+
+// Youngster is a bird ringed from a nest round.
+type Youngster struct {
+	PigeonID   int    `json:"pigeon_id"`
+	RingNumber string `json:"ring_number"`
+	Name       string `json:"name"`
+	Sex        string `json:"sex"`
+}
+
+func loadPairing(q queryer, pairingID int) (Pairing, error) {
+	var p Pairing
+	var endedOn sql.NullString
+	err := q.QueryRow(`
+		SELECT pr.pairing_id, pr.user_id, pr.cock_id, c.ring_number, pr.hen_id, h.ring_number,
+			to_char(pr.paired_on, 'YYYY-MM-DD'), to_char(pr.ended_on, 'YYYY-MM-DD'), COALESCE(pr.notes, '')
+		FROM Pairings pr
+		JOIN Pigeons c ON c.pigeon_id = pr.cock_id
+		JOIN Pigeons h ON h.pigeon_id = pr.hen_id
+		WHERE pr.pairing_id = $1
+	`, pairingID).Scan(&p.PairingID, &p.UserID, &p.CockID, &p.CockRing, &p.HenID, &p.HenRing,
+		&p.PairedOn, &endedOn, &p.Notes)
+	if err != nil {
+		return p, err
+	}
+	if endedOn.Valid {
+		p.EndedOn = &endedOn.String
+	}
+
+	rows, err := q.Query(`
+		SELECT round_id, pairing_id, round_no, to_char(laid_on, 'YYYY-MM-DD'), eggs_laid,
+			to_char(hatched_on, 'YYYY-MM-DD'), eggs_hatched, COALESCE(notes, '')
+		FROM NestRounds WHERE pairing_id = $1
+		ORDER BY round_no
+	`, pairingID)
+	if err != nil {
+		return p, err
+	}
+	p.Rounds = []NestRound{}
+	for rows.Next() {
+		var r NestRound
+		var hatchedOn sql.NullString
+		if err := rows.Scan(&r.RoundID, &r.PairingID, &r.RoundNo, &r.LaidOn, &r.EggsLaid, &hatchedOn, &r.EggsHatched, &r.Notes); err != nil {
+			rows.Close()
+			return p, err
+		}
+		if hatchedOn.Valid {
+			r.HatchedOn = &hatchedOn.String
+		}
+		p.Rounds = append(p.Rounds, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return p, err
+	}
+
+	for i := range p.Rounds {
+		if p.Rounds[i].Youngsters, err = loadYoungsters(q, p.Rounds[i].RoundID); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func loadYoungsters(q queryer, roundID int) ([]Youngster, error) {
+	rows, err := q.Query(`
+		SELECT pigeon_id, ring_number, COALESCE(name, ''), COALESCE(sex, '')
+		FROM Pigeons WHERE nest_round_id = $1
+		ORDER BY pigeon_id
+	`, roundID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	youngsters := []Youngster{}
+	for rows.Next() {
+		var y Youngster
+		if err := rows.Scan(&y.PigeonID, &y.RingNumber, &y.Name, &y.Sex); err != nil {
+			return nil, err
+		}
+		youngsters = append(youngsters, y)
+	}
+	return youngsters, rows.Err()
+}
+
+// checkBreeder verifies that pigeonID belongs to userID, has the expected
+// sex and is not already in an active pairing. The pigeon row stays locked
+// until the transaction ends, so a concurrent request cannot pair it too.
+func checkBreeder(q queryer, pigeonID, userID int, role, wantSex string) error {
+	var owner int
+	var sex string
+	err := q.QueryRow(`SELECT user_id, COALESCE(LOWER(sex), '') FROM Pigeons WHERE pigeon_id = $1 FOR UPDATE`, pigeonID).Scan(&owner, &sex)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%s %d not found", role, pigeonID)
+	}
+	if err != nil {
+		return err
+	}
+	if owner != userID {
+		return fmt.Errorf("%s %d does not belong to user %d", role, pigeonID, userID)
+	}
+	if sex != "" && sex != wantSex {
+		return fmt.Errorf("%s must be %s", role, wantSex)
+	}
+
+	var paired bool
+	err = q.QueryRow(`SELECT EXISTS (SELECT 1 FROM Pairings WHERE ended_on IS NULL AND (cock_id = $1 OR hen_id = $1))`, pigeonID).Scan(&paired)
+	if err != nil {
+		return err
+	}
+	if paired {
+		return fmt.Errorf("%s %d is already in an active pairing", role, pigeonID)
+	}
+	return nil
+}
+
+// =========================== BREEDING ===========================
+
+// CreatePairingHandler pairs a cock and a hen of the same loft.
+func CreatePairingHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var p Pairing
+		if err := c.BodyParser(&p); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if p.UserID == 0 || p.CockID == 0 || p.HenID == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "user_id, cock_id and hen_id are required"})
+		}
+		if p.PairedOn == "" {
+			p.PairedOn = time.Now().In(localZone).Format(dateLayout)
+		} else if _, err := time.Parse(dateLayout, p.PairedOn); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "paired_on must be YYYY-MM-DD"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		if err := checkBreeder(tx, p.CockID, p.UserID, "cock", "male"); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := checkBreeder(tx, p.HenID, p.UserID, "hen", "female"); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO Pairings (user_id, cock_id, hen_id, paired_on, notes)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING pairing_id`,
+			p.UserID, p.CockID, p.HenID, p.PairedOn, nullIfEmpty(p.Notes)).Scan(&p.PairingID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Pairing created", "pairing_id": p.PairingID})
+	}
+}
+
+// GetPairingsHandler lists a loft's pairings (?user_id=), active ones first.
+func GetPairingsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`
+			SELECT pairing_id FROM Pairings
+			WHERE ($1 = 0 OR user_id = $1)
+			ORDER BY ended_on IS NOT NULL, paired_on DESC
+		`, c.QueryInt("user_id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+
+		pairings := []Pairing{}
+		for _, id := range ids {
+			p, err := loadPairing(db, id)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			pairings = append(pairings, p)
+		}
+		return c.JSON(pairings)
+	}
+}
+
+// GetPairingHandler returns a pairing with its nest rounds and youngsters.
+func GetPairingHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pairingID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pairing id"})
+		}
+		p, err := loadPairing(db, pairingID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pairing not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(p)
+	}
+}
+
+// EndPairingHandler splits a pair so the birds can be paired again.
+func EndPairingHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			EndedOn string `json:"ended_on"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.EndedOn == "" {
+			input.EndedOn = time.Now().In(localZone).Format(dateLayout)
+		} else if _, err := time.Parse(dateLayout, input.EndedOn); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "ended_on must be YYYY-MM-DD"})
+		}
+
+		res, err := db.Exec(`UPDATE Pairings SET ended_on = $1 WHERE pairing_id = $2 AND ended_on IS NULL AND paired_on <= $1`,
+			input.EndedOn, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "No active pairing with this id paired on or before ended_on"})
+		}
+		return c.JSON(fiber.Map{"message": "Pairing ended"})
+	}
+}
+
+// AddNestRoundHandler records the eggs of a new nest round.
+func AddNestRoundHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pairingID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pairing id"})
+		}
+		var r NestRound
+		if err := c.BodyParser(&r); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if _, err := time.Parse(dateLayout, r.LaidOn); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "laid_on must be YYYY-MM-DD"})
+		}
+		if r.EggsLaid < 1 || r.EggsLaid > 3 {
+			return c.Status(400).JSON(fiber.Map{"error": "eggs_laid must be between 1 and 3"})
+		}
+
+		err = db.QueryRow(`
+			INSERT INTO NestRounds (pairing_id, round_no, laid_on, eggs_laid, notes)
+			SELECT pairing_id, (SELECT COALESCE(MAX(round_no), 0) + 1 FROM NestRounds WHERE pairing_id = $1), $2, $3, $4
+			FROM Pairings WHERE pairing_id = $1 AND paired_on <= $2
+			RETURNING round_id, round_no`,
+			pairingID, r.LaidOn, r.EggsLaid, nullIfEmpty(r.Notes)).Scan(&r.RoundID, &r.RoundNo)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "No pairing with this id paired on or before laid_on"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Nest round recorded", "round_id": r.RoundID, "round_no": r.RoundNo})
+	}
+}
+
+// RecordHatchHandler records when and how many eggs of a nest round hatched.
+func RecordHatchHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			HatchedOn   string `json:"hatched_on"`
+			EggsHatched int    `json:"eggs_hatched"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if _, err := time.Parse(dateLayout, input.HatchedOn); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "hatched_on must be YYYY-MM-DD"})
+		}
+		if input.EggsHatched < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "eggs_hatched cannot be negative"})
+		}
+
+		res, err := db.Exec(`
+			UPDATE NestRounds SET hatched_on = $1, eggs_hatched = $2
+			WHERE round_id = $3 AND laid_on <= $1 AND eggs_laid >= $2
+				AND $2 >= (SELECT COUNT(*) FROM Pigeons WHERE nest_round_id = round_id)`,
+			input.HatchedOn, input.EggsHatched, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Nest round not found, hatched before it was laid, more eggs hatched than laid, or fewer than already ringed"})
+		}
+		return c.JSON(fiber.Map{"message": "Hatch recorded"})
+	}
+}
+
+// RingYoungsterHandler registers a hatched youngster as a pigeon of the
+// pairing's loft, with the pairing's cock and hen as sire and dam and the
+// hatch date as birth date.
+func RingYoungsterHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roundID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid nest round id"})
+		}
+		var y struct {
+			RingNumber string `json:"ring_number"`
+			ChipNumber string `json:"chip_number"`
+			Name       string `json:"name"`
+			Color      string `json:"color"`
+			Sex        string `json:"sex"`
+		}
+		if err := c.BodyParser(&y); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if strings.TrimSpace(y.RingNumber) == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "ring_number is required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var userID, cockID, henID, hatched, ringed int
+		var hatchedOn sql.NullString
+		var breed string
+		err = tx.QueryRow(`
+			SELECT pr.user_id, pr.cock_id, pr.hen_id, to_char(nr.hatched_on, 'YYYY-MM-DD'), nr.eggs_hatched,
+				(SELECT COUNT(*) FROM Pigeons WHERE nest_round_id = nr.round_id),
+				COALESCE(NULLIF(c.breed, ''), h.breed, '')
+			FROM NestRounds nr
+			JOIN Pairings pr ON pr.pairing_id = nr.pairing_id
+			JOIN Pigeons c ON c.pigeon_id = pr.cock_id
+			JOIN Pigeons h ON h.pigeon_id = pr.hen_id
+			WHERE nr.round_id = $1
+			FOR UPDATE OF nr
+		`, roundID).Scan(&userID, &cockID, &henID, &hatchedOn, &hatched, &ringed, &breed)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Nest round not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !hatchedOn.Valid {
+			return c.Status(400).JSON(fiber.Map{"error": "Record the hatch before ringing youngsters"})
+		}
+		if ringed >= hatched {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("All %d hatched youngsters of this round are already ringed", hatched)})
+		}
+
+		var pigeonID int
+		err = tx.QueryRow(`
+			INSERT INTO Pigeons (user_id, ring_number, chip_number, name, color, sex, breed, birth_date, sire_id, dam_id, nest_round_id)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING pigeon_id`,
+			userID, y.RingNumber, nullIfEmpty(y.ChipNumber), y.Name, y.Color, y.Sex, breed, hatchedOn.String,
+			cockID, henID, roundID).Scan(&pigeonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Youngster ringed", "pigeon_id": pigeonID})
+	}
+}
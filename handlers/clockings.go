@@ -0,0 +1,532 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hvm_clocking/events"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ClockingInput is one arrival as sent by a clocking device or the web UI.
+// Sequence is the device's own counter; together with DeviceID it makes an
+// upload idempotent. Manual clockings carry who reported the arrival and a
+// verification code or photo reference the officer checks.
+type ClockingInput struct {
+	PigeonID         int     `json:"pigeon_id"`
+	RaceID           int     `json:"race_id"`
+	UserID           int     `json:"user_id"`
+	DeviceID         int     `json:"device_id"`
+	Sequence         *int64  `json:"sequence"`
+	Arrival          string  `json:"arrival_time"` // YYYY-MM-DD HH:MM:SS
+	SpeedKPH         float64 `json:"speed_kph"`
+	Source           string  `json:"source"` // device (default) | manual
+	ReportedBy       string  `json:"reported_by"`
+	VerificationCode string  `json:"verification_code"`
+	PhotoRef         string  `json:"photo_ref"`
+}
+
+// timestampLayout is the format used for times in request bodies.
+const timestampLayout = "2006-01-02 15:04:05"
+
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(timestampLayout, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// nullIfEmpty stores an omitted optional field as NULL.
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// errInvalidClocking marks recordClocking errors caused by the request rather than the database.
+var errInvalidClocking = errors.New("invalid clocking")
+
+// clockingOutcome is what recordClocking did with a clocking.
+type clockingOutcome struct {
+	ClockingID int       `json:"clocking_id"`
+	Duplicate  bool      `json:"duplicate"`
+	Status     string    `json:"status"`
+	Findings   []Finding `json:"findings,omitempty"`
+}
+
+// recordClocking runs the clocking rules, inserts the clocking with the
+// status the club policy assigns, stores any findings and publishes
+// ClockingRecorded. Rejected clockings are kept so their findings can be
+// reviewed. If the device already uploaded the same sequence number the
+// existing clocking is returned with Duplicate set and nothing is written.
+// Manual clockings that pass the rules are stored as unverified until an
+// officer approves them.
+func recordClocking(tx *sql.Tx, clk ClockingInput) (clockingOutcome, error) {
+	var out clockingOutcome
+
+	switch clk.Source {
+	case "":
+		clk.Source = SourceDevice
+	case SourceDevice:
+	case SourceManual:
+		if clk.ReportedBy == "" || (clk.VerificationCode == "" && clk.PhotoRef == "") {
+			return out, fmt.Errorf("%w: manual clockings need reported_by and a verification_code or photo_ref", errInvalidClocking)
+		}
+	default:
+		return out, fmt.Errorf("%w: source must be device or manual", errInvalidClocking)
+	}
+
+	arrival, err := parseTimestamp(clk.Arrival)
+	if err != nil {
+		return out, fmt.Errorf("%w: arrival_time must be YYYY-MM-DD HH:MM:SS", errInvalidClocking)
+	}
+	race, err := loadRaceInfo(tx, clk.RaceID)
+	if err == sql.ErrNoRows {
+		return out, fmt.Errorf("%w: race %d not found", errInvalidClocking, clk.RaceID)
+	}
+	if err != nil {
+		return out, err
+	}
+	if race.Status == RaceCancelled {
+		return out, fmt.Errorf("%w: race %d is cancelled", errInvalidClocking, clk.RaceID)
+	}
+
+	out.Findings, out.Status, err = runClockingRules(tx, clockingCheck{
+		PigeonID: clk.PigeonID,
+		RaceID:   clk.RaceID,
+		Arrival:  arrival,
+		Race:     race,
+	})
+	if err != nil {
+		return out, err
+	}
+	if clk.Source == SourceManual && out.Status != ClockingRejected {
+		out.Status = ClockingUnverified
+	}
+
+	// A concurrent upload of the same sequence waits on the unique index and
+	// then inserts nothing, so a replay is always reported as a duplicate.
+	err = tx.QueryRow(`
+		INSERT INTO Clockings (pigeon_id, race_id, user_id, device_id, device_seq, arrival_time, speed_kph, status,
+			source, reported_by, verification_code, photo_ref)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (device_id, device_seq) DO NOTHING
+		RETURNING clocking_id`,
+		clk.PigeonID, clk.RaceID, clk.UserID, clk.DeviceID, clk.Sequence, clk.Arrival, clk.SpeedKPH, out.Status,
+		clk.Source, nullIfEmpty(clk.ReportedBy), nullIfEmpty(clk.VerificationCode), nullIfEmpty(clk.PhotoRef)).Scan(&out.ClockingID)
+	if err == sql.ErrNoRows && clk.Sequence != nil {
+		out = clockingOutcome{Duplicate: true}
+		err = tx.QueryRow(`SELECT clocking_id, status FROM Clockings WHERE device_id = $1 AND device_seq = $2`,
+			clk.DeviceID, *clk.Sequence).Scan(&out.ClockingID, &out.Status)
+		return out, err
+	}
+	if err != nil {
+		return out, err
+	}
+
+	if err := saveFindings(tx, out.ClockingID, out.Findings); err != nil {
+		return out, err
+	}
+
+	err = events.Publish(tx, events.ClockingRecorded, events.ClockingRecordedPayload{
+		ClockingID: out.ClockingID,
+		PigeonID:   clk.PigeonID,
+		RaceID:     clk.RaceID,
+		UserID:     clk.UserID,
+		DeviceID:   clk.DeviceID,
+		Arrival:    clk.Arrival,
+		SpeedKPH:   clk.SpeedKPH,
+		Status:     out.Status,
+	})
+	return out, err
+}
+
+// GetClockingFindingsHandler lists the anomalies recorded against a clocking.
+func GetClockingFindingsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`
+			SELECT finding_id, rule, detail, created_at
+			FROM ClockingFindings WHERE clocking_id = $1
+			ORDER BY finding_id
+		`, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		findings := []fiber.Map{}
+		for rows.Next() {
+			var id int
+			var rule, detail, createdAt string
+			rows.Scan(&id, &rule, &detail, &createdAt)
+			findings = append(findings, fiber.Map{
+				"finding_id": id,
+				"rule":       rule,
+				"detail":     detail,
+				"created_at": createdAt,
+			})
+		}
+		return c.JSON(findings)
+	}
+}
+
+// =========================== DEVICE SYNC ===========================
+
+// SyncItemResult reports what happened to one queued clocking.
+type SyncItemResult struct {
+	Sequence   int64     `json:"sequence"`
+	Status     string    `json:"status"` // accepted | duplicate | rejected | error (retry later)
+	ClockingID int       `json:"clocking_id,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Findings   []Finding `json:"findings,omitempty"`
+}
+
+// SyncClockingsHandler accepts a batch of clockings a device queued while
+// offline. Each item is committed on its own so a bad item does not block the
+// rest, and re-sending an already accepted sequence is reported as a duplicate.
+// A rejected item is final and the cursor moves past it; an item that failed
+// on a database error is reported as "error" and must be sent again.
+func SyncClockingsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		deviceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid device id"})
+		}
+
+		var batch struct {
+			UserID    int             `json:"user_id"`
+			Clockings []ClockingInput `json:"clockings"`
+		}
+		if err := c.BodyParser(&batch); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+
+		var owner sql.NullInt64
+		err = db.QueryRow(`SELECT user_id FROM Devices WHERE device_id = $1`, deviceID).Scan(&owner)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Device not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !owner.Valid || int(owner.Int64) != batch.UserID {
+			return c.Status(403).JSON(fiber.Map{"error": "Device is not registered to this user"})
+		}
+
+		results := make([]SyncItemResult, 0, len(batch.Clockings))
+		for _, clk := range batch.Clockings {
+			results = append(results, syncOne(db, deviceID, batch.UserID, clk))
+		}
+
+		lastSeq, err := lastContiguousSequence(db, deviceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{
+			"device_id":     deviceID,
+			"last_sequence": lastSeq,
+			"results":       results,
+		})
+	}
+}
+
+func syncOne(db *sql.DB, deviceID, userID int, clk ClockingInput) SyncItemResult {
+	if clk.Sequence == nil {
+		return SyncItemResult{Status: "rejected", Error: "sequence is required"}
+	}
+	res := SyncItemResult{Sequence: *clk.Sequence}
+
+	if clk.PigeonID == 0 || clk.RaceID == 0 || clk.Arrival == "" {
+		return rejectSequence(db, deviceID, res, "pigeon_id, race_id and arrival_time are required")
+	}
+
+	clk.DeviceID = deviceID
+	if clk.UserID == 0 {
+		clk.UserID = userID
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		res.Status = "error"
+		res.Error = "DB transaction failed"
+		return res
+	}
+	defer tx.Rollback()
+
+	out, err := recordClocking(tx, clk)
+	if errors.Is(err, errInvalidClocking) {
+		tx.Rollback()
+		return rejectSequence(db, deviceID, res, err.Error())
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+		return res
+	}
+
+	res.ClockingID = out.ClockingID
+	res.Findings = out.Findings
+	switch {
+	case out.Duplicate:
+		res.Status = "duplicate"
+	case out.Status == ClockingRejected:
+		res.Status = "rejected"
+		res.Error = "Clocking rejected by club anomaly rules"
+	default:
+		// accepted or quarantined: the device must not resend it either way
+		res.Status = "accepted"
+	}
+	return res
+}
+
+// rejectSequence records that a device sequence was refused for good, so
+// lastContiguousSequence can move past it. If that cannot be stored the item
+// is reported as an error and the device sends it again.
+func rejectSequence(db *sql.DB, deviceID int, res SyncItemResult, reason string) SyncItemResult {
+	_, err := db.Exec(`
+		INSERT INTO DeviceSyncRejections (device_id, device_seq, error) VALUES ($1, $2, $3)
+		ON CONFLICT (device_id, device_seq) DO NOTHING`, deviceID, res.Sequence, reason)
+	if err != nil {
+		res.Status = "error"
+		res.Error = err.Error()
+		return res
+	}
+	res.Status = "rejected"
+	res.Error = reason
+	return res
+}
+
+// lastContiguousSequence returns the highest sequence N such that 1..N are
+// all stored or rejected for the device. The device resumes uploading from N+1.
+func lastContiguousSequence(db *sql.DB, deviceID int) (int64, error) {
+	rows, err := db.Query(`
+		SELECT device_seq FROM Clockings WHERE device_id = $1 AND device_seq IS NOT NULL
+		UNION
+		SELECT device_seq FROM DeviceSyncRejections WHERE device_id = $1
+		ORDER BY device_seq`, deviceID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var last int64
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			return 0, err
+		}
+		if seq != last+1 {
+			break
+		}
+		last = seq
+	}
+	return last, rows.Err()
+}
+
+// GetDeviceSyncStateHandler tells a device where to resume a partial upload.
+func GetDeviceSyncStateHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		deviceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid device id"})
+		}
+
+		lastSeq, err := lastContiguousSequence(db, deviceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var total, rejected int
+		var maxSeq sql.NullInt64
+		err = db.QueryRow(`
+			SELECT
+				(SELECT COUNT(*) FROM Clockings WHERE device_id = $1 AND device_seq IS NOT NULL),
+				(SELECT COUNT(*) FROM DeviceSyncRejections WHERE device_id = $1),
+				GREATEST(
+					(SELECT MAX(device_seq) FROM Clockings WHERE device_id = $1),
+					(SELECT MAX(device_seq) FROM DeviceSyncRejections WHERE device_id = $1))`, deviceID).
+			Scan(&total, &rejected, &maxSeq)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		return c.JSON(fiber.Map{
+			"device_id":      deviceID,
+			"last_sequence":  lastSeq,
+			"max_sequence":   maxSeq.Int64,
+			"stored_count":   total,
+			"rejected_count": rejected,
+			"next_sequence":  lastSeq + 1,
+		})
+	}
+}
+
+// ReviewClockingHandler lets a club officer accept or reject a quarantined
+// clocking. The decision is final: recomputing results does not change it.
+// Clockings invalidated by a race status change cannot be reviewed back in.
+func ReviewClockingHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			OfficerID int    `json:"officer_id"`
+			Status    string `json:"status"` // accepted | rejected
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.Status != ClockingAccepted && input.Status != ClockingRejected {
+			return c.Status(400).JSON(fiber.Map{"error": "status must be accepted or rejected"})
+		}
+		ok, err := isClubOfficer(db, input.OfficerID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only club officers can review clockings"})
+		}
+
+		res, err := db.Exec(`
+			UPDATE Clockings SET status = $1, reviewed_by = $2, reviewed_at = NOW()
+			WHERE clocking_id = $3 AND status NOT IN ($4, $5, $6)
+		`, input.Status, input.OfficerID, c.Params("id"), ClockingUnverified, ClockingInvalidated, ClockingRejected)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// Manual clockings go through VerifyClockingHandler instead;
+			// rejected and invalidated clockings stay out of the race.
+			return c.Status(404).JSON(fiber.Map{"error": "Clocking not found, awaiting officer verification, rejected or invalidated"})
+		}
+		return c.JSON(fiber.Map{"message": "Clocking reviewed"})
+	}
+}
+
+// isClubOfficer reports whether a user may verify clockings.
+func isClubOfficer(q queryer, userID int) (bool, error) {
+	var ok bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM Users WHERE user_id = $1 AND role IN ('admin', 'officer'))`, userID).Scan(&ok)
+	return ok, err
+}
+
+// VerifyClockingHandler lets a club officer approve or reject a manual
+// clocking. Only approved manual clockings are counted by the result engine.
+func VerifyClockingHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			OfficerID int  `json:"officer_id"`
+			Approve   bool `json:"approve"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		ok, err := isClubOfficer(db, input.OfficerID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only club officers can verify clockings"})
+		}
+
+		status := ClockingRejected
+		if input.Approve {
+			status = ClockingAccepted
+		}
+		res, err := db.Exec(`
+			UPDATE Clockings SET status = $1, reviewed_by = $2, reviewed_at = NOW()
+			WHERE clocking_id = $3 AND status = $4
+		`, status, input.OfficerID, c.Params("id"), ClockingUnverified)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "No unverified clocking with this id"})
+		}
+		return c.JSON(fiber.Map{"message": "Clocking verified", "status": status})
+	}
+}
+
+// GetUnverifiedClockingsHandler lists the manual clockings of a race waiting
+// for an officer, with the findings recorded against each.
+func GetUnverifiedClockingsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`
+			SELECT c.clocking_id, c.pigeon_id, p.ring_number, c.user_id, to_char(c.arrival_time, 'YYYY-MM-DD HH24:MI:SS'),
+				COALESCE(c.reported_by, ''), COALESCE(c.verification_code, ''), COALESCE(c.photo_ref, '')
+			FROM Clockings c
+			JOIN Pigeons p ON p.pigeon_id = c.pigeon_id
+			WHERE c.race_id = $1 AND c.status = $2
+			ORDER BY c.arrival_time
+		`, c.Params("id"), ClockingUnverified)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		findings, err := loadUnverifiedFindings(db, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		clockings := []fiber.Map{}
+		for rows.Next() {
+			var clockingID, pigeonID, userID int
+			var ring, arrival, reportedBy, code, photo string
+			if err := rows.Scan(&clockingID, &pigeonID, &ring, &userID, &arrival, &reportedBy, &code, &photo); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			flagged := findings[clockingID]
+			if flagged == nil {
+				flagged = []Finding{}
+			}
+			clockings = append(clockings, fiber.Map{
+				"clocking_id":       clockingID,
+				"pigeon_id":         pigeonID,
+				"ring_number":       ring,
+				"user_id":           userID,
+				"arrival_time":      arrival,
+				"reported_by":       reportedBy,
+				"verification_code": code,
+				"photo_ref":         photo,
+				"findings":          flagged,
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(clockings)
+	}
+}
+
+// loadUnverifiedFindings returns the findings of every unverified clocking
+// of a race, by clocking id, so the officer sees why a clocking was flagged.
+func loadUnverifiedFindings(q queryer, raceID string) (map[int][]Finding, error) {
+	rows, err := q.Query(`
+		SELECT f.clocking_id, f.rule, f.detail
+		FROM ClockingFindings f
+		JOIN Clockings c ON c.clocking_id = f.clocking_id
+		WHERE c.race_id = $1 AND c.status = $2
+		ORDER BY f.finding_id
+	`, raceID, ClockingUnverified)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	findings := map[int][]Finding{}
+	for rows.Next() {
+		var clockingID int
+		var f Finding
+		if err := rows.Scan(&clockingID, &f.Rule, &f.Detail); err != nil {
+			return nil, err
+		}
+		findings[clockingID] = append(findings[clockingID], f)
+	}
+	return findings, rows.Err()
+}
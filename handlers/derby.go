@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Race types
+const (
+	RaceStandard   = "standard"
+	RaceHotSpot    = "hotspot"     // intermediate one-loft race
+	RaceDerbyFinal = "derby_final" // the one-loft race the main prizes are paid on
+)
+
+// Derby is a one-loft race series: birds from many owners live and are
+// clocked at one central loft, so every bird flies the same distance.
+type Derby struct {
+	DerbyID       int       `json:"derby_id"`
+	ClubID        *int      `json:"club_id"`
+	Name          string    `json:"name"`
+	EntryFee      float64   `json:"entry_fee"`      // per bird
+	PrizeFundPct  float64   `json:"prize_fund_pct"` // share of entry fees paid out as prizes
+	HotSpotPct    float64   `json:"hotspot_pct"`    // share of the prize fund paid to hot-spot winners
+	FinalSplit    []float64 `json:"final_split"`    // % of the final prize money per position
+	HotSpotPlaces int       `json:"hotspot_places"` // paid places per hot spot
+}
+
+// DerbyPrize is one payout of a derby.
+type DerbyPrize struct {
+	RaceID     int     `json:"race_id"`
+	RaceName   string  `json:"race_name"`
+	RaceType   string  `json:"race_type"`
+	Position   int     `json:"position"`
+	PigeonID   int     `json:"pigeon_id"`
+	RingNumber string  `json:"ring_number"`
+	UserID     int     `json:"user_id"`
+	Owner      string  `json:"owner"`
+	Amount     float64 `json:"amount"`
+}
+
+func loadDerby(q queryer, derbyID int) (Derby, error) {
+	d := Derby{DerbyID: derbyID}
+	var clubID sql.NullInt64
+	var split []byte
+	err := q.QueryRow(`
+		SELECT club_id, name, entry_fee, prize_fund_pct, hotspot_pct, final_split, hotspot_places
+		FROM Derbies WHERE derby_id = $1
+	`, derbyID).Scan(&clubID, &d.Name, &d.EntryFee, &d.PrizeFundPct, &d.HotSpotPct, &split, &d.HotSpotPlaces)
+	if err != nil {
+		return d, err
+	}
+	if clubID.Valid {
+		id := int(clubID.Int64)
+		d.ClubID = &id
+	}
+	err = json.Unmarshal(split, &d.FinalSplit)
+	return d, err
+}
+
+// =========================== DERBIES ===========================
+func CreateDerbyHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var d Derby
+		if err := c.BodyParser(&d); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if d.Name == "" || d.EntryFee < 0 || d.PrizeFundPct < 0 || d.PrizeFundPct > 100 || d.HotSpotPct < 0 || d.HotSpotPct > 100 ||
+			d.HotSpotPlaces < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid derby settings"})
+		}
+		if err := validatePercentages("final_split", d.FinalSplit); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if d.FinalSplit == nil {
+			d.FinalSplit = []float64{}
+		}
+		if d.HotSpotPlaces == 0 {
+			d.HotSpotPlaces = 1
+		}
+		split, _ := json.Marshal(d.FinalSplit)
+
+		var derbyID int
+		err := db.QueryRow(`
+			INSERT INTO Derbies (club_id, name, entry_fee, prize_fund_pct, hotspot_pct, final_split, hotspot_places)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING derby_id`,
+			d.ClubID, d.Name, d.EntryFee, d.PrizeFundPct, d.HotSpotPct, split, d.HotSpotPlaces).Scan(&derbyID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Derby created", "derby_id": derbyID})
+	}
+}
+
+// AddDerbyEntryHandler enters a bird into a derby with its fee. The bird is
+// also basketed for every derby race that has not been released yet.
+func AddDerbyEntryHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		derbyID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid derby id"})
+		}
+		var input struct {
+			PigeonID int      `json:"pigeon_id"`
+			FeePaid  *float64 `json:"fee_paid"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		derby, err := loadDerby(tx, derbyID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Derby not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		fee := derby.EntryFee
+		if input.FeePaid != nil {
+			fee = *input.FeePaid
+		}
+		if fee < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "fee_paid cannot be negative"})
+		}
+
+		res, err := tx.Exec(`
+			INSERT INTO DerbyEntries (derby_id, pigeon_id, user_id, fee_paid)
+			SELECT $1, pigeon_id, user_id, $3 FROM Pigeons WHERE pigeon_id = $2
+			ON CONFLICT (derby_id, pigeon_id) DO NOTHING
+		`, derbyID, input.PigeonID, fee)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Pigeons WHERE pigeon_id = $1)`, input.PigeonID).Scan(&exists); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if !exists {
+				return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+			}
+			return c.Status(409).JSON(fiber.Map{"error": "Pigeon is already entered in this derby"})
+		}
+
+		rows, err := tx.Query(`SELECT race_id FROM Races WHERE derby_id = $1 AND status IN ($2, $3)`,
+			derbyID, RaceScheduled, RacePostponed)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var raceIDs []int
+		for rows.Next() {
+			var id int
+			rows.Scan(&id)
+			raceIDs = append(raceIDs, id)
+		}
+		rows.Close()
+
+		for _, raceID := range raceIDs {
+			_, err := basketPigeon(tx, raceID, input.PigeonID)
+			var be *basketError
+			if errors.As(err, &be) {
+				return c.Status(422).JSON(fiber.Map{"error": be.Error(), "missing": be.Missing})
+			}
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Bird entered in derby"})
+	}
+}
+
+// enterDerbyBirds registers every derby entry in a newly created derby race
+// and returns why any bird could not be basketed for it.
+func enterDerbyBirds(tx *sql.Tx, derbyID, raceID int) ([]string, error) {
+	rows, err := tx.Query(`SELECT pigeon_id FROM DerbyEntries WHERE derby_id = $1`, derbyID)
+	if err != nil {
+		return nil, err
+	}
+	var pigeonIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pigeonIDs = append(pigeonIDs, id)
+	}
+	rows.Close()
+
+	refused := []string{}
+	for _, pigeonID := range pigeonIDs {
+		_, err := basketPigeon(tx, raceID, pigeonID)
+		var be *basketError
+		if errors.As(err, &be) {
+			refused = append(refused, be.Error())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refused, nil
+}
+
+// computeDerbyPrizes distributes the derby prize fund from the stored race
+// results: HotSpotPct of the fund is shared equally over the hot spots that
+// were not cancelled and
+// paid to their first HotSpotPlaces birds, the rest is paid on the final by
+// FinalSplit.
+func computeDerbyPrizes(q queryer, derby Derby) (float64, []DerbyPrize, error) {
+	var fees float64
+	if err := q.QueryRow(`SELECT COALESCE(SUM(fee_paid), 0) FROM DerbyEntries WHERE derby_id = $1`, derby.DerbyID).Scan(&fees); err != nil {
+		return 0, nil, err
+	}
+	fund := roundCents(fees * derby.PrizeFundPct / 100)
+
+	rows, err := q.Query(`SELECT race_id, race_type FROM Races WHERE derby_id = $1 AND status <> 'cancelled' ORDER BY release_time`, derby.DerbyID)
+	if err != nil {
+		return 0, nil, err
+	}
+	type derbyRace struct {
+		id       int
+		raceType string
+	}
+	var races []derbyRace
+	hotSpots := 0
+	for rows.Next() {
+		var r derbyRace
+		if err := rows.Scan(&r.id, &r.raceType); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		if r.raceType == RaceHotSpot {
+			hotSpots++
+		}
+		races = append(races, r)
+	}
+	rows.Close()
+
+	hotSpotFund := 0.0
+	if hotSpots > 0 {
+		hotSpotFund = fund * derby.HotSpotPct / 100
+	}
+	finalFund := fund - hotSpotFund
+
+	prizes := []DerbyPrize{}
+	for _, r := range races {
+		var amounts []float64
+		switch r.raceType {
+		case RaceHotSpot:
+			perPlace := roundCents(hotSpotFund / float64(hotSpots) / float64(derby.HotSpotPlaces))
+			for i := 0; i < derby.HotSpotPlaces; i++ {
+				amounts = append(amounts, perPlace)
+			}
+		case RaceDerbyFinal:
+			for _, pct := range derby.FinalSplit {
+				amounts = append(amounts, roundCents(finalFund*pct/100))
+			}
+		default:
+			continue
+		}
+
+		res, err := q.Query(`
+			SELECT rr.rank, r.name, p.pigeon_id, p.ring_number, e.user_id, COALESCE(u.full_name, u.username)
+			FROM RaceResults rr
+			JOIN Races r ON r.race_id = rr.race_id
+			JOIN Pigeons p ON p.pigeon_id = rr.pigeon_id
+			JOIN DerbyEntries e ON e.derby_id = r.derby_id AND e.pigeon_id = rr.pigeon_id
+			JOIN Users u ON u.user_id = e.user_id
+			WHERE rr.race_id = $1 AND rr.rank BETWEEN 1 AND $2
+			ORDER BY rr.rank
+		`, r.id, len(amounts))
+		if err != nil {
+			return 0, nil, err
+		}
+		for res.Next() {
+			p := DerbyPrize{RaceID: r.id, RaceType: r.raceType}
+			if err := res.Scan(&p.Position, &p.RaceName, &p.PigeonID, &p.RingNumber, &p.UserID, &p.Owner); err != nil {
+				res.Close()
+				return 0, nil, err
+			}
+			p.Amount = amounts[p.Position-1]
+			prizes = append(prizes, p)
+		}
+		res.Close()
+	}
+	return fund, prizes, nil
+}
+
+// DistributeDerbyPrizesHandler computes and stores the derby payouts.
+func DistributeDerbyPrizesHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		derbyID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid derby id"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		derby, err := loadDerby(tx, derbyID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Derby not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		fund, prizes, err := computeDerbyPrizes(tx, derby)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if _, err := tx.Exec(`DELETE FROM DerbyPrizes WHERE derby_id = $1`, derbyID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		for _, p := range prizes {
+			_, err := tx.Exec(`
+				INSERT INTO DerbyPrizes (derby_id, race_id, position, pigeon_id, user_id, amount)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				derbyID, p.RaceID, p.Position, p.PigeonID, p.UserID, p.Amount)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Derby prizes distributed", "prize_fund": fund, "prizes": prizes})
+	}
+}
+
+// GetDerbyHandler returns a derby with its races, hot-spot winners, entries
+// and stored payouts.
+func GetDerbyHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		derbyID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid derby id"})
+		}
+		derby, err := loadDerby(db, derbyID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Derby not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		rows, err := db.Query(`
+			SELECT r.race_id, r.name, r.race_type, r.release_time,
+				w.ring_number, COALESCE(wu.full_name, wu.username, ''), COALESCE(rr.speed_kph, 0)
+			FROM Races r
+			LEFT JOIN RaceResults rr ON rr.race_id = r.race_id AND rr.rank = 1
+			LEFT JOIN Pigeons w ON w.pigeon_id = rr.pigeon_id
+			LEFT JOIN DerbyEntries e ON e.derby_id = r.derby_id AND e.pigeon_id = rr.pigeon_id
+			LEFT JOIN Users wu ON wu.user_id = e.user_id
+			WHERE r.derby_id = $1
+			ORDER BY r.release_time
+		`, derbyID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		races := []fiber.Map{}
+		for rows.Next() {
+			var raceID int
+			var name, raceType, releaseTime, owner string
+			var winner sql.NullString
+			var speed float64
+			rows.Scan(&raceID, &name, &raceType, &releaseTime, &winner, &owner, &speed)
+			races = append(races, fiber.Map{
+				"race_id":      raceID,
+				"name":         name,
+				"race_type":    raceType,
+				"release_time": releaseTime,
+				"winner_ring":  winner.String,
+				"winner_owner": owner,
+				"winner_speed": speed,
+			})
+		}
+
+		var entries int
+		var fees float64
+		db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(fee_paid), 0) FROM DerbyEntries WHERE derby_id = $1`, derbyID).Scan(&entries, &fees)
+
+		prizeRows, err := db.Query(`
+			SELECT dp.race_id, r.name, r.race_type, dp.position, dp.pigeon_id, p.ring_number, dp.user_id,
+				COALESCE(u.full_name, u.username), dp.amount
+			FROM DerbyPrizes dp
+			JOIN Races r ON r.race_id = dp.race_id
+			JOIN Pigeons p ON p.pigeon_id = dp.pigeon_id
+			JOIN Users u ON u.user_id = dp.user_id
+			WHERE dp.derby_id = $1
+			ORDER BY r.release_time, dp.position
+		`, derbyID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer prizeRows.Close()
+
+		prizes := []DerbyPrize{}
+		for prizeRows.Next() {
+			var p DerbyPrize
+			prizeRows.Scan(&p.RaceID, &p.RaceName, &p.RaceType, &p.Position, &p.PigeonID, &p.RingNumber, &p.UserID, &p.Owner, &p.Amount)
+			prizes = append(prizes, p)
+		}
+
+		return c.JSON(fiber.Map{
+			"derby":      derby,
+			"races":      races,
+			"entries":    entries,
+			"entry_fees": fees,
+			"prizes":     prizes,
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/xuri/excelize/v2"
+)
+
+// resultSheet is a race result as printed for the club board.
+type resultSheet struct {
+	RaceName    string
+	ReleaseTime string
+	Weather     string
+	Birds       int // basketed
+	Lofts       int // lofts with at least one basketed bird
+	Lines       []ResultLine
+}
+
+var resultColumns = []string{"Pos", "Fancier", "Ring", "Distance (km)", "Arrival", "Velocity (m/min)", "Prize", "Penalty"}
+
+func loadResultSheet(db *sql.DB, raceID int) (resultSheet, error) {
+	var s resultSheet
+	err := db.QueryRow(`
+		SELECT r.name, to_char(r.release_time, 'YYYY-MM-DD HH24:MI:SS'), COALESCE(r.weather, ''),
+			(SELECT COUNT(*) FROM RaceParticipants rp WHERE rp.race_id = r.race_id AND rp.status = 'entered'),
+			(SELECT COUNT(DISTINCT pigeon_owner_at(rp.pigeon_id, r.release_time)) FROM RaceParticipants rp
+				WHERE rp.race_id = r.race_id AND rp.status = 'entered')
+		FROM Races r WHERE r.race_id = $1
+	`, raceID).Scan(&s.RaceName, &s.ReleaseTime, &s.Weather, &s.Birds, &s.Lofts)
+	if err != nil {
+		return s, err
+	}
+	s.Lines, err = loadStoredResults(db, raceID)
+	return s, err
+}
+
+func (s resultSheet) header() []string {
+	weather := s.Weather
+	if weather == "" {
+		weather = "-"
+	}
+	return []string{
+		s.RaceName,
+		fmt.Sprintf("Release: %s   Weather: %s", s.ReleaseTime, weather),
+		fmt.Sprintf("Birds: %d   Lofts: %d", s.Birds, s.Lofts),
+	}
+}
+
+// row formats one result line; velocity is shown in metres per minute as on
+// traditional result sheets.
+func (s resultSheet) row(l ResultLine) []string {
+	pos := strconv.Itoa(l.Rank)
+	switch {
+	case l.Disqualified:
+		pos = "DQ"
+	case l.OutsideRace:
+		pos = "OUT"
+	}
+	prize := ""
+	if l.Prize {
+		prize = fmt.Sprintf("%.2f", l.PrizeAmount)
+	}
+	return []string{
+		pos,
+		l.Fancier,
+		l.RingNumber,
+		fmt.Sprintf("%.3f", l.DistanceKM),
+		l.Arrival.Format(timestampLayout),
+		fmt.Sprintf("%.3f", l.SpeedKPH*1000/60),
+		prize,
+		describePenalty(l),
+	}
+}
+
+func writeResultsCSV(w io.Writer, s resultSheet) error {
+	cw := csv.NewWriter(w)
+	for _, line := range s.header() {
+		cw.Write([]string{line})
+	}
+	cw.Write(nil)
+	cw.Write(resultColumns)
+	for _, l := range s.Lines {
+		cw.Write(s.row(l))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeResultsXLSX(w io.Writer, s resultSheet) error {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	const sheet = "Results"
+	f.SetSheetName("Sheet1", sheet)
+
+	bold, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+
+	for i, line := range s.header() {
+		cell, _ := excelize.CoordinatesToCellName(1, i+1)
+		f.SetCellValue(sheet, cell, line)
+	}
+	f.SetCellStyle(sheet, "A1", "A1", bold)
+
+	headerRow := len(s.header()) + 2
+	for col, name := range resultColumns {
+		cell, _ := excelize.CoordinatesToCellName(col+1, headerRow)
+		f.SetCellValue(sheet, cell, name)
+	}
+	first, _ := excelize.CoordinatesToCellName(1, headerRow)
+	last, _ := excelize.CoordinatesToCellName(len(resultColumns), headerRow)
+	f.SetCellStyle(sheet, first, last, bold)
+
+	for i, l := range s.Lines {
+		for col, value := range s.row(l) {
+			cell, _ := excelize.CoordinatesToCellName(col+1, headerRow+1+i)
+			f.SetCellValue(sheet, cell, value)
+		}
+	}
+	f.SetColWidth(sheet, "B", "C", 22)
+	f.SetColWidth(sheet, "D", "G", 18)
+	f.SetColWidth(sheet, "H", "H", 30)
+
+	return f.Write(w)
+}
+
+func writeResultsPDF(w io.Writer, s resultSheet) error {
+	pdf := fpdf.New("L", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	header := s.header()
+	pdf.SetFont("Helvetica", "B", 14)
+	pdf.CellFormat(0, 8, tr(header[0]), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, line := range header[1:] {
+		pdf.CellFormat(0, 6, tr(line), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	widths := []float64{14, 50, 35, 27, 40, 32, 25, 54}
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.SetFillColor(240, 242, 245)
+	for i, name := range resultColumns {
+		pdf.CellFormat(widths[i], 7, name, "1", 0, "C", true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 9)
+	for _, l := range s.Lines {
+		for i, value := range s.row(l) {
+			align := "L"
+			if i == 0 || i >= 3 {
+				align = "R"
+			}
+			pdf.CellFormat(widths[i], 6, tr(value), "1", 0, align, false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+
+	return pdf.Output(w)
+}
+
+// exportResults renders a result sheet in the requested format and returns
+// the body and its content type.
+func exportResults(s resultSheet, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var err error
+	var contentType string
+	switch format {
+	case "csv":
+		contentType = "text/csv"
+		err = writeResultsCSV(&buf, s)
+	case "xlsx":
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		err = writeResultsXLSX(&buf, s)
+	case "pdf":
+		contentType = "application/pdf"
+		err = writeResultsPDF(&buf, s)
+	default:
+		return nil, "", fmt.Errorf("format must be csv, xlsx or pdf")
+	}
+	return buf.Bytes(), contentType, err
+}
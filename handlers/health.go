@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Health record kinds
+const (
+	HealthVaccination = "vaccination"
+	HealthTreatment   = "treatment"
+	HealthVetVisit    = "vet_visit"
+)
+
+// vaccinationValidity is how long a vaccination lasts when the record does
+// not give an expiry date.
+var vaccinationValidity = map[string]time.Duration{
+	"paramyxo": 365 * 24 * time.Hour,
+}
+
+// HealthRecord is a vaccination, treatment or vet visit of a pigeon.
+type HealthRecord struct {
+	RecordID       int       `json:"record_id"`
+	PigeonID       int       `json:"pigeon_id"`
+	Kind           string    `json:"kind"`
+	Name           string    `json:"name"` // e.g. paramyxo, canker, respiratory
+	Product        string    `json:"product"`
+	AdministeredOn string    `json:"administered_on"` // YYYY-MM-DD
+	ExpiresOn      *string   `json:"expires_on"`
+	VetName        string    `json:"vet_name"`
+	Notes          string    `json:"notes"`
+	RecordedBy     int       `json:"recorded_by"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// missingVaccinations returns the vaccinations the race's club requires that
+// the pigeon does not hold on race day (the release date).
+func missingVaccinations(q queryer, pigeonID, raceID int) ([]string, string, error) {
+	var required []byte
+	var raceDay string
+	err := q.QueryRow(`
+		SELECT COALESCE(cl.required_vaccinations, '["paramyxo"]'), to_char(r.release_time, 'YYYY-MM-DD')
+		FROM Races r
+		LEFT JOIN Clubs cl ON cl.club_id = r.club_id
+		WHERE r.race_id = $1
+	`, raceID).Scan(&required, &raceDay)
+	if err != nil {
+		return nil, "", err
+	}
+	var names []string
+	if err := json.Unmarshal(required, &names); err != nil {
+		return nil, "", err
+	}
+
+	var missing []string
+	for _, name := range names {
+		var valid bool
+		err := q.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM HealthRecords
+				WHERE pigeon_id = $1 AND kind = $2 AND LOWER(name) = LOWER($3)
+					AND administered_on <= $4::date AND (expires_on IS NULL OR expires_on >= $4::date)
+			)`, pigeonID, HealthVaccination, name, raceDay).Scan(&valid)
+		if err != nil {
+			return nil, "", err
+		}
+		if !valid {
+			missing = append(missing, name)
+		}
+	}
+	return missing, raceDay, nil
+}
+
+// =========================== HEALTH ===========================
+
+// AddHealthRecordHandler records a vaccination, treatment or vet visit.
+// Vaccinations with a known validity get their expiry date filled in.
+func AddHealthRecordHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		var r HealthRecord
+		if err := c.BodyParser(&r); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if r.Kind != HealthVaccination && r.Kind != HealthTreatment && r.Kind != HealthVetVisit {
+			return c.Status(400).JSON(fiber.Map{"error": "kind must be vaccination, treatment or vet_visit"})
+		}
+		r.Name = strings.TrimSpace(r.Name)
+		if r.Name == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+		}
+		administered, err := time.Parse(dateLayout, r.AdministeredOn)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "administered_on must be YYYY-MM-DD"})
+		}
+		if r.ExpiresOn != nil {
+			expires, err := time.Parse(dateLayout, *r.ExpiresOn)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "expires_on must be YYYY-MM-DD"})
+			}
+			if expires.Before(administered) {
+				return c.Status(400).JSON(fiber.Map{"error": "expires_on is before administered_on"})
+			}
+		} else if validity, ok := vaccinationValidity[strings.ToLower(r.Name)]; ok && r.Kind == HealthVaccination {
+			expires := administered.Add(validity).Format(dateLayout)
+			r.ExpiresOn = &expires
+		}
+
+		var recordedBy interface{}
+		if r.RecordedBy != 0 {
+			recordedBy = r.RecordedBy
+		}
+
+		err = db.QueryRow(`
+			INSERT INTO HealthRecords (pigeon_id, kind, name, product, administered_on, expires_on, vet_name, notes, recorded_by)
+			SELECT pigeon_id, $2, $3, $4, $5, $6, $7, $8, $9 FROM Pigeons WHERE pigeon_id = $1
+			RETURNING record_id`,
+			pigeonID, r.Kind, r.Name, nullIfEmpty(r.Product), r.AdministeredOn, r.ExpiresOn,
+			nullIfEmpty(r.VetName), nullIfEmpty(r.Notes), recordedBy).Scan(&r.RecordID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Health record added", "record_id": r.RecordID, "expires_on": r.ExpiresOn})
+	}
+}
+
+// GetHealthRecordsHandler returns a pigeon's health log, newest first.
+func GetHealthRecordsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`
+			SELECT record_id, pigeon_id, kind, name, COALESCE(product, ''), to_char(administered_on, 'YYYY-MM-DD'),
+				to_char(expires_on, 'YYYY-MM-DD'), COALESCE(vet_name, ''), COALESCE(notes, ''), COALESCE(recorded_by, 0), created_at
+			FROM HealthRecords WHERE pigeon_id = $1
+			ORDER BY administered_on DESC, record_id DESC
+		`, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		records := []HealthRecord{}
+		for rows.Next() {
+			var r HealthRecord
+			var expiresOn sql.NullString
+			err := rows.Scan(&r.RecordID, &r.PigeonID, &r.Kind, &r.Name, &r.Product, &r.AdministeredOn,
+				&expiresOn, &r.VetName, &r.Notes, &r.RecordedBy, &r.CreatedAt)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if expiresOn.Valid {
+				r.ExpiresOn = &expiresOn.String
+			}
+			records = append(records, r)
+		}
+		return c.JSON(records)
+	}
+}
+
+// GetVaccinationStatusHandler tells whether a pigeon may be basketed for a
+// race (?race_id=) and which required vaccinations it lacks.
+func GetVaccinationStatusHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		raceID := c.QueryInt("race_id")
+		if raceID == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "race_id is required"})
+		}
+		missing, raceDay, err := missingVaccinations(db, pigeonID, raceID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if missing == nil {
+			missing = []string{}
+		}
+		return c.JSON(fiber.Map{"race_day": raceDay, "eligible": len(missing) == 0, "missing": missing})
+	}
+}
+
+// vaccinationError is the message for a bird refused at basketing.
+func vaccinationError(ring string, missing []string, raceDay string) string {
+	return fmt.Sprintf("Pigeon %s has no valid %s vaccination on race day %s", ring, strings.Join(missing, ", "), raceDay)
+}
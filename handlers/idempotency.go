@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// IdempotencyKeyHeader is the request header clients set to make a POST safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyLease is how long a claim without a stored response blocks
+// retries; after that the first request is taken to have died.
+const idempotencyLease = time.Minute
+
+// idempotencySkipped are paths whose responses must never be stored, such as
+// the login response.
+var idempotencySkipped = map[string]bool{
+	"/login": true,
+}
+
+// IdempotencyMiddleware replays the stored response when a POST is repeated
+// with the same Idempotency-Key by the same caller within the retention
+// window. A key reused with a different method, path or body is rejected with
+// 422, and a key whose first request is still running is rejected with 409.
+// Keys are scoped to the caller (its Authorization header, or its address
+// when it sends none), so two clients picking the same key do not collide.
+// A claim whose request died without a response is taken over once
+// idempotencyLease has passed.
+//
+// Server errors (5xx) are not stored, so the client can retry them.
+func IdempotencyMiddleware(db *sql.DB, retention time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyKeyHeader)
+		if c.Method() != fiber.MethodPost || key == "" || idempotencySkipped[c.Path()] {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return c.Status(400).JSON(fiber.Map{"error": "Idempotency-Key is too long"})
+		}
+
+		sum := sha256.New()
+		sum.Write([]byte(c.Method() + " " + c.Path() + "\n"))
+		sum.Write(c.Body())
+		requestHash := hex.EncodeToString(sum.Sum(nil))
+		caller := idempotencyCaller(c)
+
+		// Claim the key, taking it over if it has expired but has not been
+		// purged yet, or if its request never stored a response within the
+		// lease. If another request holds it, look at what it stored.
+		res, err := db.Exec(`
+			INSERT INTO IdempotencyKeys (caller, idempotency_key, request_hash)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (caller, idempotency_key) DO UPDATE
+			SET request_hash = EXCLUDED.request_hash, status_code = NULL, content_type = '',
+				response_body = NULL, created_at = NOW()
+			WHERE IdempotencyKeys.created_at < NOW() - make_interval(secs => $4)
+				OR (IdempotencyKeys.status_code IS NULL AND IdempotencyKeys.created_at < NOW() - make_interval(secs => $5))
+		`, caller, key, requestHash, retention.Seconds(), idempotencyLease.Seconds())
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if claimed, _ := res.RowsAffected(); claimed == 0 {
+			var storedHash, contentType string
+			var statusCode sql.NullInt64
+			var body []byte
+			err := db.QueryRow(`
+				SELECT request_hash, status_code, content_type, response_body
+				FROM IdempotencyKeys WHERE caller = $1 AND idempotency_key = $2
+			`, caller, key).Scan(&storedHash, &statusCode, &contentType, &body)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+
+			if storedHash != requestHash {
+				return c.Status(422).JSON(fiber.Map{"error": "Idempotency-Key was already used with a different request"})
+			}
+			if !statusCode.Valid {
+				return c.Status(409).JSON(fiber.Map{"error": "A request with this Idempotency-Key is still in progress"})
+			}
+
+			c.Set("Idempotent-Replayed", "true")
+			c.Set(fiber.HeaderContentType, contentType)
+			return c.Status(int(statusCode.Int64)).Send(body)
+		}
+
+		if err := c.Next(); err != nil {
+			db.Exec(`DELETE FROM IdempotencyKeys WHERE caller = $1 AND idempotency_key = $2`, caller, key)
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		if status >= 500 {
+			db.Exec(`DELETE FROM IdempotencyKeys WHERE caller = $1 AND idempotency_key = $2`, caller, key)
+			return nil
+		}
+
+		_, err = db.Exec(`
+			UPDATE IdempotencyKeys
+			SET status_code = $1, content_type = $2, response_body = $3
+			WHERE caller = $4 AND idempotency_key = $5
+		`, status, string(c.Response().Header.ContentType()), c.Response().Body(), caller, key)
+		if err != nil {
+			log.Println("⚠️ Failed to store idempotent response:", err)
+		}
+		return nil
+	}
+}
+
+// idempotencyCaller identifies who sent a request: a hash of its
+// Authorization header, or its IP address when it sends none.
+func idempotencyCaller(c *fiber.Ctx) string {
+	if auth := c.Get(fiber.HeaderAuthorization); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return hex.EncodeToString(sum[:])
+	}
+	return c.IP()
+}
+
+// PurgeIdempotencyKeys deletes expired keys every interval until ctx is done.
+func PurgeIdempotencyKeys(ctx context.Context, db *sql.DB, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := db.Exec(`DELETE FROM IdempotencyKeys WHERE created_at < NOW() - make_interval(secs => $1)`, retention.Seconds())
+			if err != nil {
+				log.Println("⚠️ Failed to purge idempotency keys:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"hvm_clocking/events"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LiberationReport is the convoyer's account of a race release.
+type LiberationReport struct {
+	ReportID     int       `json:"report_id"`
+	RaceID       int       `json:"race_id"`
+	ConvoyerID   int       `json:"convoyer_id"`
+	ReleaseTime  string    `json:"release_time"` // YYYY-MM-DD HH:MM:SS
+	Weather      string    `json:"weather"`
+	WindDir      string    `json:"wind_direction"`
+	WindSpeedKPH float64   `json:"wind_speed_kph"`
+	CrateCount   int       `json:"crate_count"`
+	Remarks      string    `json:"remarks"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// =========================== LIBERATION ===========================
+
+// canLiberate reports whether a user may file liberation reports: a club
+// officer or a fancier given the convoyer role.
+func canLiberate(q queryer, userID int) (bool, error) {
+	var ok bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM Users WHERE user_id = $1 AND role IN ('admin', 'officer', 'convoyer'))`, userID).Scan(&ok)
+	return ok, err
+}
+
+// SubmitLiberationReportHandler records the actual release of a race. The
+// race's release time and weather are updated (the scheduled time is kept),
+// the results are recomputed as a new provisional revision if any birds
+// have been clocked, and the participants are notified via RaceLiberated.
+func SubmitLiberationReportHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		var r LiberationReport
+		if err := c.BodyParser(&r); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if r.ConvoyerID == 0 || r.CrateCount <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "convoyer_id and crate_count are required"})
+		}
+		released, err := parseTimestamp(r.ReleaseTime)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "release_time must be YYYY-MM-DD HH:MM:SS"})
+		}
+		r.ReleaseTime = released.Format(timestampLayout)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		ok, err := canLiberate(tx, r.ConvoyerID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only officers and convoyers can submit liberation reports"})
+		}
+
+		var scheduled, newDate time.Time
+		var status string
+		err = tx.QueryRow(`SELECT COALESCE(scheduled_release_time, release_time), release_time, status FROM Races WHERE race_id = $1`, raceID).
+			Scan(&scheduled, &newDate, &status)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if status == RaceCancelled {
+			return c.Status(409).JSON(fiber.Map{"error": "Race is cancelled"})
+		}
+		if status == RacePostponed && released.Format(dateLayout) < newDate.Format(dateLayout) {
+			return c.Status(409).JSON(fiber.Map{"error": "Race is postponed to " + newDate.Format(dateLayout)})
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO LiberationReports (race_id, convoyer_id, release_time, weather, wind_direction, wind_speed_kph, crate_count, remarks)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING report_id`,
+			raceID, r.ConvoyerID, r.ReleaseTime, nullIfEmpty(r.Weather), nullIfEmpty(r.WindDir), r.WindSpeedKPH,
+			r.CrateCount, nullIfEmpty(r.Remarks)).Scan(&r.ReportID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		weather := r.Weather
+		if r.WindDir != "" {
+			wind := fmt.Sprintf("wind %s %.0f km/h", r.WindDir, r.WindSpeedKPH)
+			if weather == "" {
+				weather = wind
+			} else {
+				weather += ", " + wind
+			}
+		}
+		_, err = tx.Exec(`
+			UPDATE Races SET release_time = $1, weather = COALESCE($2, weather), liberated_at = NOW(), status = 'released',
+				scheduled_release_time = COALESCE(scheduled_release_time, $3)
+			WHERE race_id = $4`,
+			r.ReleaseTime, nullIfEmpty(weather), scheduled.Format(timestampLayout), raceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		resp := fiber.Map{"message": "Liberation report recorded", "report_id": r.ReportID}
+
+		var clocked bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Clockings WHERE race_id = $1)`, raceID).Scan(&clocked); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if clocked {
+			rev, err := recomputeRaceResults(tx, raceID, "liberation report: released at "+r.ReleaseTime, &r.ConvoyerID, nil)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			resp["revision_no"] = rev.RevisionNo
+		}
+
+		delay := released.Sub(scheduled).Minutes()
+		err = events.Publish(tx, events.RaceLiberated, events.RaceLiberatedPayload{
+			RaceID:           raceID,
+			ScheduledRelease: scheduled.Format(timestampLayout),
+			ActualRelease:    r.ReleaseTime,
+			DelayMinutes:     delay,
+			Weather:          weather,
+		})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		resp["delay_minutes"] = delay
+		return c.JSON(resp)
+	}
+}
+
+// GetLiberationHandler returns the scheduled and actual release of a race
+// together with every liberation report submitted for it.
+func GetLiberationHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+
+		var scheduled, actual string
+		var liberatedAt sql.NullTime
+		err = db.QueryRow(`
+			SELECT to_char(COALESCE(scheduled_release_time, release_time), 'YYYY-MM-DD HH24:MI:SS'),
+				to_char(release_time, 'YYYY-MM-DD HH24:MI:SS'), liberated_at
+			FROM Races WHERE race_id = $1`, raceID).Scan(&scheduled, &actual, &liberatedAt)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		rows, err := db.Query(`
+			SELECT report_id, race_id, convoyer_id, to_char(release_time, 'YYYY-MM-DD HH24:MI:SS'),
+				COALESCE(weather, ''), COALESCE(wind_direction, ''), COALESCE(wind_speed_kph, 0),
+				crate_count, COALESCE(remarks, ''), created_at
+			FROM LiberationReports WHERE race_id = $1
+			ORDER BY report_id
+		`, raceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		reports := []LiberationReport{}
+		for rows.Next() {
+			var r LiberationReport
+			err := rows.Scan(&r.ReportID, &r.RaceID, &r.ConvoyerID, &r.ReleaseTime, &r.Weather, &r.WindDir,
+				&r.WindSpeedKPH, &r.CrateCount, &r.Remarks, &r.CreatedAt)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			reports = append(reports, r)
+		}
+
+		resp := fiber.Map{
+			"scheduled_release": scheduled,
+			"actual_release":    nil,
+			"reports":           reports,
+		}
+		if liberatedAt.Valid {
+			resp["actual_release"] = actual
+		}
+		return c.JSON(resp)
+	}
+}
@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/lib/pq"
+)
+
+// Pigeon statuses
+const (
+	PigeonActive   = "active"
+	PigeonLost     = "lost"
+	PigeonFound    = "found"
+	PigeonReturned = "returned" // back in the loft after being lost
+	PigeonDeceased = "deceased"
+)
+
+// pigeonStatusMoves lists the statuses an owner may move a bird to from each
+// status. A public found report only moves a lost bird to found.
+var pigeonStatusMoves = map[string][]string{
+	PigeonActive:   {PigeonLost, PigeonDeceased},
+	PigeonLost:     {PigeonFound, PigeonReturned, PigeonDeceased},
+	PigeonFound:    {PigeonLost, PigeonReturned, PigeonDeceased},
+	PigeonReturned: {PigeonLost, PigeonDeceased},
+	PigeonDeceased: {},
+}
+
+// canBasket reports whether a bird with this status can be entered in a race.
+func canBasket(status string) bool {
+	return status == PigeonActive || status == PigeonReturned
+}
+
+// PigeonStatusChange is one entry in a pigeon's status history.
+type PigeonStatusChange struct {
+	ChangeID  int       `json:"change_id"`
+	Status    string    `json:"status"`
+	RaceID    *int      `json:"race_id"`
+	ChangedBy *int      `json:"changed_by"` // nil for a public found report
+	Notes     string    `json:"notes"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// FoundReport is a finder's report of a stray bird.
+type FoundReport struct {
+	ReportID      int       `json:"report_id"`
+	RingNumber    string    `json:"ring_number"`
+	FinderName    string    `json:"finder_name"`
+	FinderContact string    `json:"finder_contact"`
+	Location      string    `json:"location"`
+	Latitude      *float64  `json:"latitude"`
+	Longitude     *float64  `json:"longitude"`
+	Message       string    `json:"message"`
+	ReportedAt    time.Time `json:"reported_at"`
+}
+
+// LostPigeon is a missing bird as listed publicly, without owner details.
+type LostPigeon struct {
+	PigeonID   int       `json:"pigeon_id"`
+	RingNumber string    `json:"ring_number"`
+	Color      string    `json:"color"`
+	Sex        string    `json:"sex"`
+	RaceID     *int      `json:"race_id"`
+	RaceName   string    `json:"race_name"`
+	LostSince  time.Time `json:"lost_since"`
+}
+
+// setPigeonStatus changes a pigeon's status and records the change.
+func setPigeonStatus(q queryer, pigeonID int, status string, raceID, changedBy int, notes string) error {
+	if _, err := q.Exec(`UPDATE Pigeons SET status = $1 WHERE pigeon_id = $2`, status, pigeonID); err != nil {
+		return err
+	}
+	var race, by interface{}
+	if raceID != 0 {
+		race = raceID
+	}
+	if changedBy != 0 {
+		by = changedBy
+	}
+	_, err := q.Exec(`INSERT INTO PigeonStatusChanges (pigeon_id, status, race_id, changed_by, notes) VALUES ($1, $2, $3, $4, $5)`,
+		pigeonID, status, race, by, nullIfEmpty(notes))
+	return err
+}
+
+// normalizeRing makes a ring number typed by a finder comparable to the
+// registered one: case and spacing are ignored.
+func normalizeRing(ring string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(ring), ""))
+}
+
+// =========================== LOST AND FOUND ===========================
+
+// MarkMissingHandler marks the birds of a released race that have not been
+// clocked as lost. The owner marks their own birds; a club officer may mark
+// anyone's. Without pigeon_ids every unclocked entered bird of the owner (or,
+// for an officer, of every fancier) is marked.
+func MarkMissingHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		var input struct {
+			UserID    int    `json:"user_id"`
+			PigeonIDs []int  `json:"pigeon_ids"`
+			Notes     string `json:"notes"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.UserID == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "user_id is required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var status string
+		err = tx.QueryRow(`SELECT status FROM Races WHERE race_id = $1`, raceID).Scan(&status)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if status != RaceReleased {
+			return c.Status(409).JSON(fiber.Map{"error": "Birds can only be marked missing after the race is released"})
+		}
+		officer, err := isClubOfficer(tx, input.UserID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		rows, err := tx.Query(`
+			SELECT p.pigeon_id, p.ring_number, p.user_id
+			FROM RaceParticipants rp
+			JOIN Pigeons p ON p.pigeon_id = rp.pigeon_id
+			WHERE rp.race_id = $1 AND rp.status = $2
+				AND p.status IN ($3, $4)
+				AND ($5 OR p.user_id = $6)
+				AND (COALESCE(cardinality($7::int[]), 0) = 0 OR p.pigeon_id = ANY($7))
+				AND NOT EXISTS (SELECT 1 FROM Clockings c WHERE c.race_id = rp.race_id AND c.pigeon_id = p.pigeon_id
+					AND c.status NOT IN ('rejected', 'invalidated'))
+			ORDER BY p.ring_number
+			FOR UPDATE OF p
+		`, raceID, EntryEntered, PigeonActive, PigeonReturned, officer, input.UserID, pq.Array(input.PigeonIDs))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		type missing struct {
+			id      int
+			ring    string
+			ownerID int
+		}
+		var birds []missing
+		for rows.Next() {
+			var m missing
+			if err := rows.Scan(&m.id, &m.ring, &m.ownerID); err != nil {
+				rows.Close()
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			birds = append(birds, m)
+		}
+		rows.Close()
+		if len(birds) == 0 {
+			return c.Status(409).JSON(fiber.Map{"error": "No unclocked birds to mark missing in this race"})
+		}
+
+		marked := []string{}
+		for _, m := range birds {
+			if err := setPigeonStatus(tx, m.id, PigeonLost, raceID, input.UserID, input.Notes); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if m.ownerID != input.UserID {
+				err := notifyUser(tx, m.ownerID, "Pigeon marked missing",
+					fmt.Sprintf("Pigeon %s did not return from race %d and has been listed as lost.", m.ring, raceID))
+				if err != nil {
+					return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+				}
+			}
+			marked = append(marked, m.ring)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Pigeons marked missing", "ring_numbers": marked})
+	}
+}
+
+// UpdatePigeonStatusHandler lets the owner record that a bird was found,
+// came home or died, or report a bird lost outside a race.
+func UpdatePigeonStatusHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		var input struct {
+			UserID int    `json:"user_id"`
+			Status string `json:"status"`
+			Notes  string `json:"notes"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var ownerID int
+		var current string
+		err = tx.QueryRow(`SELECT user_id, status FROM Pigeons WHERE pigeon_id = $1 FOR UPDATE`, pigeonID).Scan(&ownerID, &current)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if ownerID != input.UserID {
+			return c.Status(403).JSON(fiber.Map{"error": "Only the owner can change this pigeon's status"})
+		}
+
+		allowed := false
+		for _, s := range pigeonStatusMoves[current] {
+			allowed = allowed || s == input.Status
+		}
+		if !allowed {
+			return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("A %s pigeon cannot be marked %q", current, input.Status)})
+		}
+
+		if err := setPigeonStatus(tx, pigeonID, input.Status, 0, input.UserID, input.Notes); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Pigeon status updated", "status": input.Status})
+	}
+}
+
+// ReportFoundPigeonHandler is the public "found a pigeon" form. The finder
+// gives the ring number and how to reach them; the owner is notified with
+// those details, and the finder never sees who the owner is. Only a bird
+// listed as lost is marked found.
+func ReportFoundPigeonHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var r FoundReport
+		if err := c.BodyParser(&r); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		r.FinderName = strings.TrimSpace(r.FinderName)
+		r.FinderContact = strings.TrimSpace(r.FinderContact)
+		if normalizeRing(r.RingNumber) == "" || r.FinderName == "" || r.FinderContact == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "ring_number, finder_name and finder_contact are required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var pigeonID, ownerID int
+		var ring, status string
+		err = tx.QueryRow(`
+			SELECT pigeon_id, user_id, ring_number, status FROM Pigeons
+			WHERE upper(regexp_replace(ring_number, '\s', '', 'g')) = $1
+			FOR UPDATE`, normalizeRing(r.RingNumber)).Scan(&pigeonID, &ownerID, &ring, &status)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "This ring number is not registered with the club. Please check it and try again."})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var lat, lng interface{}
+		if r.Latitude != nil && r.Longitude != nil {
+			lat, lng = *r.Latitude, *r.Longitude
+		}
+		err = tx.QueryRow(`
+			INSERT INTO FoundReports (pigeon_id, ring_number, finder_name, finder_contact, location, latitude, longitude, message)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING report_id`,
+			pigeonID, strings.TrimSpace(r.RingNumber), r.FinderName, r.FinderContact, nullIfEmpty(r.Location), lat, lng,
+			nullIfEmpty(r.Message)).Scan(&r.ReportID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		// Only a bird listed as lost changes status; for any other bird the
+		// report is kept and passed on to the owner to judge.
+		if status == PigeonLost {
+			if err := setPigeonStatus(tx, pigeonID, PigeonFound, 0, 0, fmt.Sprintf("Found report %d", r.ReportID)); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		body := fmt.Sprintf("%s found pigeon %s", r.FinderName, ring)
+		if r.Location != "" {
+			body += " at " + r.Location
+		}
+		body += ". Contact them at " + r.FinderContact + "."
+		if r.Message != "" {
+			body += " Message: " + r.Message
+		}
+		if err := notifyUser(tx, ownerID, "Your pigeon has been found", body); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{
+			"message":   "Thank you. The owner has been notified and will contact you.",
+			"report_id": r.ReportID,
+		})
+	}
+}
+
+// GetLostPigeonsHandler is the public list of missing birds (?race_id=).
+// Owner details are left out.
+func GetLostPigeonsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`
+			SELECT p.pigeon_id, p.ring_number, COALESCE(p.color, ''), COALESCE(p.sex, ''),
+				sc.race_id, COALESCE(r.name, ''), sc.changed_at
+			FROM Pigeons p
+			JOIN LATERAL (
+				SELECT race_id, changed_at FROM PigeonStatusChanges
+				WHERE pigeon_id = p.pigeon_id AND status = $1
+				ORDER BY changed_at DESC LIMIT 1
+			) sc ON true
+			LEFT JOIN Races r ON r.race_id = sc.race_id
+			WHERE p.status = $1 AND ($2 = 0 OR sc.race_id = $2)
+			ORDER BY sc.changed_at DESC
+		`, PigeonLost, c.QueryInt("race_id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		lost := []LostPigeon{}
+		for rows.Next() {
+			var l LostPigeon
+			var raceID sql.NullInt64
+			if err := rows.Scan(&l.PigeonID, &l.RingNumber, &l.Color, &l.Sex, &raceID, &l.RaceName, &l.LostSince); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			l.RaceID = nullIntPtr(raceID)
+			lost = append(lost, l)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(lost)
+	}
+}
+
+// GetPigeonStatusHistoryHandler returns a pigeon's status changes and the
+// found reports made for it. Finder contact details are shown only to the
+// owner or a club officer (?user_id=).
+func GetPigeonStatusHistoryHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		userID := c.QueryInt("user_id")
+
+		var ownerID int
+		var status string
+		err = db.QueryRow(`SELECT user_id, status FROM Pigeons WHERE pigeon_id = $1`, pigeonID).Scan(&ownerID, &status)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		officer, err := isClubOfficer(db, userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if userID != ownerID && !officer {
+			return c.Status(403).JSON(fiber.Map{"error": "Only the owner or a club officer can view this history"})
+		}
+
+		rows, err := db.Query(`
+			SELECT change_id, status, race_id, changed_by, COALESCE(notes, ''), changed_at
+			FROM PigeonStatusChanges WHERE pigeon_id = $1
+			ORDER BY changed_at, change_id
+		`, pigeonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		changes := []PigeonStatusChange{}
+		for rows.Next() {
+			var ch PigeonStatusChange
+			var raceID, changedBy sql.NullInt64
+			if err := rows.Scan(&ch.ChangeID, &ch.Status, &raceID, &changedBy, &ch.Notes, &ch.ChangedAt); err != nil {
+				rows.Close()
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			ch.RaceID = nullIntPtr(raceID)
+			ch.ChangedBy = nullIntPtr(changedBy)
+			changes = append(changes, ch)
+		}
+		rows.Close()
+
+		rows, err = db.Query(`
+			SELECT report_id, ring_number, finder_name, finder_contact, COALESCE(location, ''),
+				latitude, longitude, COALESCE(message, ''), reported_at
+			FROM FoundReports WHERE pigeon_id = $1
+			ORDER BY reported_at DESC
+		`, pigeonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+		reports := []FoundReport{}
+		for rows.Next() {
+			var r FoundReport
+			var lat, lng sql.NullFloat64
+			err := rows.Scan(&r.ReportID, &r.RingNumber, &r.FinderName, &r.FinderContact, &r.Location,
+				&lat, &lng, &r.Message, &r.ReportedAt)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if lat.Valid && lng.Valid {
+				r.Latitude, r.Longitude = &lat.Float64, &lng.Float64
+			}
+			reports = append(reports, r)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"pigeon_id": pigeonID, "status": status, "changes": changes, "found_reports": reports})
+	}
+}
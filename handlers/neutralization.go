@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// localZone is the zone race timestamps are recorded in (Philippine time).
+// Sunrise and sunset are computed in UTC and shifted into it.
+var localZone = time.FixedZone("PHT", 8*60*60)
+
+// Flying window modes. Outside the daily window the clock is neutralized:
+// those hours do not count toward flying time.
+const (
+	WindowNone  = "none"  // the clock runs day and night
+	WindowFixed = "fixed" // day_start..day_end every day
+	WindowSun   = "sun"   // sunrise..sunset at the release point
+)
+
+// flyingWindow describes the daily hours that count toward flying time.
+type flyingWindow struct {
+	Mode     string
+	DayStart time.Duration // offset from local midnight, fixed mode
+	DayEnd   time.Duration
+	Lat, Lng float64 // release point, sun mode
+}
+
+// dayBounds returns the counted interval of the local day containing t.
+func (w flyingWindow) dayBounds(t time.Time) (time.Time, time.Time) {
+	lt := t.In(localZone)
+	midnight := time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, localZone)
+	if w.Mode == WindowSun {
+		if rise, set, ok := sunTimes(midnight, w.Lat, w.Lng); ok {
+			return rise, set
+		}
+	}
+	return midnight.Add(w.DayStart), midnight.Add(w.DayEnd)
+}
+
+// flyingDuration is the time between release and arrival that falls inside
+// the daily flying windows.
+func flyingDuration(release, arrival time.Time, w flyingWindow) time.Duration {
+	if !arrival.After(release) {
+		return 0
+	}
+	if w.Mode == "" || w.Mode == WindowNone {
+		return arrival.Sub(release)
+	}
+	release, arrival = wallClock(release), wallClock(arrival)
+
+	var total time.Duration
+	day := release
+	for !day.After(arrival) {
+		start, end := w.dayBounds(day)
+		if start.Before(release) {
+			start = release
+		}
+		if end.After(arrival) {
+			end = arrival
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+		}
+
+		lt := day.In(localZone)
+		day = time.Date(lt.Year(), lt.Month(), lt.Day()+1, 0, 0, 0, 0, localZone)
+	}
+	return total
+}
+
+// sunTimes computes sunrise and sunset for the given day with the NOAA
+// sunrise equation. ok is false during polar day or night.
+func sunTimes(day time.Time, lat, lng float64) (sunrise, sunset time.Time, ok bool) {
+	const rad = math.Pi / 180
+
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, time.UTC)
+	jd := float64(noon.Unix())/86400 + 2440587.5
+	n := math.Round(jd - 2451545.0 + 0.0008)
+
+	jStar := n - lng/360
+	m := math.Mod(357.5291+0.98560028*jStar, 360)
+	c := 1.9148*math.Sin(m*rad) + 0.02*math.Sin(2*m*rad) + 0.0003*math.Sin(3*m*rad)
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	jTransit := 2451545.0 + jStar + 0.0053*math.Sin(m*rad) - 0.0069*math.Sin(2*lambda*rad)
+
+	sinDecl := math.Sin(lambda*rad) * math.Sin(23.4397*rad)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+	cosH := (math.Sin(-0.833*rad) - math.Sin(lat*rad)*sinDecl) / (math.Cos(lat*rad) * cosDecl)
+	if cosH < -1 || cosH > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	h := math.Acos(cosH) / rad
+
+	fromJulian := func(j float64) time.Time {
+		secs := (j - 2440587.5) * 86400
+		return time.Unix(int64(secs), 0).In(localZone)
+	}
+	return fromJulian(jTransit - h/360), fromJulian(jTransit + h/360), true
+}
+
+// parseClockTime parses HH:MM or HH:MM:SS into an offset from midnight.
+func parseClockTime(s string) (time.Duration, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+}
+
+// wallClock reinterprets a TIMESTAMP (stored without zone and scanned as UTC)
+// as a wall-clock time in localZone.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), localZone)
+}
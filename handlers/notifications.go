@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"hvm_clocking/events"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Notification is an in-app message to a user.
+type Notification struct {
+	NotificationID int        `json:"notification_id"`
+	Subject        string     `json:"subject"`
+	Body           string     `json:"body"`
+	ReadAt         *time.Time `json:"read_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func notifyUser(q queryer, userID int, subject, body string) error {
+	_, err := q.Exec(`INSERT INTO Notifications (user_id, subject, body) VALUES ($1, $2, $3)`, userID, subject, body)
+	return err
+}
+
+// notifyRaceParticipants sends the same message to the owner at release of
+// every bird still entered in a race; refunded and carried-over entries are
+// left out.
+func notifyRaceParticipants(q queryer, raceID int, subject, body string) error {
+	rows, err := q.Query(`
+		SELECT DISTINCT pigeon_owner_at(rp.pigeon_id, r.release_time)
+		FROM RaceParticipants rp
+		JOIN Races r ON r.race_id = rp.race_id
+		WHERE rp.race_id = $1 AND rp.status = $2
+	`, raceID, EntryEntered)
+	if err != nil {
+		return err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range userIDs {
+		if err := notifyUser(q, id, subject, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotifyRaceLiberated tells every fancier with birds in the race about the
+// actual release. It is run by the notifications event subscriber.
+func NotifyRaceLiberated(db *sql.DB, p events.RaceLiberatedPayload) error {
+	var raceName string
+	if err := db.QueryRow(`SELECT name FROM Races WHERE race_id = $1`, p.RaceID).Scan(&raceName); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("The birds were released at %s.", p.ActualRelease)
+	if p.DelayMinutes != 0 {
+		body = fmt.Sprintf("The birds were released at %s (scheduled %s, %+.0f min).", p.ActualRelease, p.ScheduledRelease, p.DelayMinutes)
+	}
+	if p.Weather != "" {
+		body += " Weather: " + p.Weather + "."
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := notifyRaceParticipants(tx, p.RaceID, raceName+" liberated", body); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// =========================== NOTIFICATIONS ===========================
+
+// GetUserNotificationsHandler lists a user's notifications, newest first.
+// ?unread=true leaves out the ones already read.
+func GetUserNotificationsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid user id"})
+		}
+		rows, err := db.Query(`
+			SELECT notification_id, subject, body, read_at, created_at
+			FROM Notifications
+			WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)
+			ORDER BY notification_id DESC
+		`, userID, c.QueryBool("unread"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		notifications := []Notification{}
+		for rows.Next() {
+			var n Notification
+			var readAt sql.NullTime
+			if err := rows.Scan(&n.NotificationID, &n.Subject, &n.Body, &readAt, &n.CreatedAt); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if readAt.Valid {
+				n.ReadAt = &readAt.Time
+			}
+			notifications = append(notifications, n)
+		}
+		return c.JSON(notifications)
+	}
+}
+
+// MarkNotificationReadHandler marks a notification as read.
+func MarkNotificationReadHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		res, err := db.Exec(`UPDATE Notifications SET read_at = COALESCE(read_at, NOW()) WHERE notification_id = $1`, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "Notification not found"})
+		}
+		return c.JSON(fiber.Map{"message": "Notification read"})
+	}
+}
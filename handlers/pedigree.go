@@ -0,0 +1,378 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxPedigreeGenerations bounds the size of a pedigree tree.
+const maxPedigreeGenerations = 8
+
+// PedigreeNode is one pigeon in a pedigree tree. Ancestors known only by an
+// external ring number have External set and no PigeonID.
+type PedigreeNode struct {
+	PigeonID    *int             `json:"pigeon_id"`
+	RingNumber  string           `json:"ring_number"`
+	Name        string           `json:"name,omitempty"`
+	Color       string           `json:"color,omitempty"`
+	Sex         string           `json:"sex,omitempty"`
+	Breed       string           `json:"breed,omitempty"`
+	External    bool             `json:"external"`
+	Cycle       bool             `json:"cycle,omitempty"` // pigeon already appears below it in the tree
+	Performance *RacePerformance `json:"performance,omitempty"`
+	Sire        *PedigreeNode    `json:"sire"`
+	Dam         *PedigreeNode    `json:"dam"`
+}
+
+// RacePerformance summarises a pigeon's stored race results.
+type RacePerformance struct {
+	Races        int               `json:"races"`
+	Wins         int               `json:"wins"`
+	Prizes       int               `json:"prizes"`
+	BestRank     int               `json:"best_rank"`
+	BestSpeedKPH float64           `json:"best_speed_kph"`
+	Best         []PerformanceLine `json:"best"` // up to three best placings
+}
+
+// PerformanceLine is one placing of a pigeon.
+type PerformanceLine struct {
+	RaceName   string  `json:"race_name"`
+	RaceDate   string  `json:"race_date"`
+	Rank       int     `json:"rank"`
+	DistanceKM float64 `json:"distance_km"`
+	SpeedKPH   float64 `json:"speed_kph"`
+}
+
+func (p RacePerformance) String() string {
+	if p.Races == 0 {
+		return "No race results"
+	}
+	var parts []string
+	for _, l := range p.Best {
+		parts = append(parts, fmt.Sprintf("%d. %s (%.0f km)", l.Rank, l.RaceName, l.DistanceKM))
+	}
+	return fmt.Sprintf("%d races, %d wins, %d prizes. %s", p.Races, p.Wins, p.Prizes, strings.Join(parts, "; "))
+}
+
+func loadRacePerformance(q queryer, pigeonID int) (*RacePerformance, error) {
+	rows, err := q.Query(`
+		SELECT r.name, to_char(r.release_time, 'YYYY-MM-DD'), COALESCE(rr.rank, 0),
+			COALESCE(rr.distance_km, r.distance_km, 0), COALESCE(rr.speed_kph, 0), rr.prize
+		FROM RaceResults rr
+		JOIN Races r ON r.race_id = rr.race_id
+		WHERE rr.pigeon_id = $1
+		ORDER BY rr.rank IS NULL, rr.rank, r.release_time DESC
+	`, pigeonID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	perf := &RacePerformance{Best: []PerformanceLine{}}
+	for rows.Next() {
+		var l PerformanceLine
+		var prize bool
+		if err := rows.Scan(&l.RaceName, &l.RaceDate, &l.Rank, &l.DistanceKM, &l.SpeedKPH, &prize); err != nil {
+			return nil, err
+		}
+		perf.Races++
+		if l.Rank == 1 {
+			perf.Wins++
+		}
+		if prize {
+			perf.Prizes++
+		}
+		if l.SpeedKPH > perf.BestSpeedKPH {
+			perf.BestSpeedKPH = l.SpeedKPH
+		}
+		if l.Rank > 0 {
+			if perf.BestRank == 0 {
+				perf.BestRank = l.Rank
+			}
+			if len(perf.Best) < 3 {
+				perf.Best = append(perf.Best, l)
+			}
+		}
+	}
+	return perf, rows.Err()
+}
+
+// pigeonParents are a pigeon's sire and dam references.
+type pigeonParents struct {
+	SireID, DamID     sql.NullInt64
+	SireRing, DamRing sql.NullString
+}
+
+func loadPedigreeNode(q queryer, pigeonID int) (PedigreeNode, pigeonParents, error) {
+	n := PedigreeNode{PigeonID: &pigeonID}
+	var par pigeonParents
+	err := q.QueryRow(`
+		SELECT ring_number, COALESCE(name, ''), COALESCE(color, ''), COALESCE(sex, ''), COALESCE(breed, ''),
+			sire_id, dam_id, sire_ring, dam_ring
+		FROM Pigeons WHERE pigeon_id = $1
+	`, pigeonID).Scan(&n.RingNumber, &n.Name, &n.Color, &n.Sex, &n.Breed,
+		&par.SireID, &par.DamID, &par.SireRing, &par.DamRing)
+	return n, par, err
+}
+
+// loadPedigree builds the tree of pigeonID up to generations deep (the pigeon
+// itself is generation 1). A pigeon that is its own ancestor is reported with
+// Cycle set instead of being expanded again.
+func loadPedigree(q queryer, pigeonID, generations int) (*PedigreeNode, error) {
+	return pedigreeNode(q, pigeonID, generations, map[int]bool{})
+}
+
+func pedigreeNode(q queryer, pigeonID, generations int, path map[int]bool) (*PedigreeNode, error) {
+	n, par, err := loadPedigreeNode(q, pigeonID)
+	if err != nil {
+		return nil, err
+	}
+	if path[pigeonID] {
+		n.Cycle = true
+		return &n, nil
+	}
+	if n.Performance, err = loadRacePerformance(q, pigeonID); err != nil {
+		return nil, err
+	}
+	if generations <= 1 {
+		return &n, nil
+	}
+
+	path[pigeonID] = true
+	defer delete(path, pigeonID)
+
+	parent := func(id sql.NullInt64, ring sql.NullString) (*PedigreeNode, error) {
+		switch {
+		case id.Valid:
+			return pedigreeNode(q, int(id.Int64), generations-1, path)
+		case ring.Valid:
+			return &PedigreeNode{RingNumber: ring.String, External: true}, nil
+		}
+		return nil, nil
+	}
+	if n.Sire, err = parent(par.SireID, par.SireRing); err != nil {
+		return nil, err
+	}
+	if n.Dam, err = parent(par.DamID, par.DamRing); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// isAncestor reports whether ancestorID appears anywhere in the lineage of
+// pigeonID (pigeonID itself included).
+func isAncestor(q queryer, ancestorID, pigeonID int) (bool, error) {
+	var found bool
+	err := q.QueryRow(`
+		WITH RECURSIVE lineage(pigeon_id) AS (
+			SELECT $2::int
+			UNION
+			SELECT parent.id
+			FROM lineage l
+			JOIN Pigeons p ON p.pigeon_id = l.pigeon_id
+			CROSS JOIN LATERAL (VALUES (p.sire_id), (p.dam_id)) AS parent(id)
+			WHERE parent.id IS NOT NULL
+		)
+		SELECT EXISTS (SELECT 1 FROM lineage WHERE pigeon_id = $1)
+	`, ancestorID, pigeonID).Scan(&found)
+	return found, err
+}
+
+// resolveParent turns a parent given by id or ring number into an internal
+// reference when the ring belongs to a pigeon in the system. wantSex is
+// "male" or "female"; internal parents of the wrong sex are refused.
+func resolveParent(q queryer, childID int, id *int, ring, role, wantSex string) (interface{}, interface{}, error) {
+	if id == nil && ring != "" {
+		var found int
+		err := q.QueryRow(`SELECT pigeon_id FROM Pigeons WHERE UPPER(ring_number) = UPPER($1)`, ring).Scan(&found)
+		if err == nil {
+			id = &found
+		} else if err != sql.ErrNoRows {
+			return nil, nil, err
+		}
+	}
+	if id == nil {
+		return nil, nullIfEmpty(ring), nil
+	}
+
+	if *id == childID {
+		return nil, nil, fmt.Errorf("a pigeon cannot be its own %s", role)
+	}
+	var sex string
+	err := q.QueryRow(`SELECT COALESCE(LOWER(sex), '') FROM Pigeons WHERE pigeon_id = $1`, *id).Scan(&sex)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("%s %d not found", role, *id)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if sex != "" && sex != wantSex {
+		return nil, nil, fmt.Errorf("%s must be %s", role, wantSex)
+	}
+	cycle, err := isAncestor(q, childID, *id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cycle {
+		return nil, nil, fmt.Errorf("%s %d descends from this pigeon; the lineage would form a cycle", role, *id)
+	}
+	return *id, nil, nil
+}
+
+// =========================== PEDIGREE ===========================
+
+// SetPigeonParentsHandler sets a pigeon's sire and dam, each either a pigeon
+// in the system (id or ring number) or an external ring number.
+func SetPigeonParentsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		var input struct {
+			SireID   *int   `json:"sire_id"`
+			SireRing string `json:"sire_ring"`
+			DamID    *int   `json:"dam_id"`
+			DamRing  string `json:"dam_ring"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Pigeons WHERE pigeon_id = $1)`, pigeonID).Scan(&exists); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !exists {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+
+		sireID, sireRing, err := resolveParent(tx, pigeonID, input.SireID, input.SireRing, "sire", "male")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		damID, damRing, err := resolveParent(tx, pigeonID, input.DamID, input.DamRing, "dam", "female")
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		_, err = tx.Exec(`UPDATE Pigeons SET sire_id = $1, sire_ring = $2, dam_id = $3, dam_ring = $4 WHERE pigeon_id = $5`,
+			sireID, sireRing, damID, damRing, pigeonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Parents updated"})
+	}
+}
+
+func pedigreeGenerations(c *fiber.Ctx, def int) (int, error) {
+	n := c.QueryInt("generations", def)
+	if n < 1 || n > maxPedigreeGenerations {
+		return 0, fmt.Errorf("generations must be between 1 and %d", maxPedigreeGenerations)
+	}
+	return n, nil
+}
+
+// GetPedigreeHandler returns the pedigree tree of a pigeon, ?generations=N
+// deep (default 4).
+func GetPedigreeHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		generations, err := pedigreeGenerations(c, 4)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		tree, err := loadPedigree(db, pigeonID, generations)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(tree)
+	}
+}
+
+// pedigreeCell is one box of the printed pedigree grid.
+type pedigreeCell struct {
+	Node    *PedigreeNode
+	Rowspan int
+	Role    string // Sire or Dam, empty for the pigeon itself
+}
+
+// pedigreeGrid lays a tree out as table rows: generation g occupies column g
+// and each of its boxes spans 2^(generations-1-g) rows.
+func pedigreeGrid(root *PedigreeNode, generations int) [][]pedigreeCell {
+	rows := 1 << (generations - 1)
+	grid := make([][]pedigreeCell, rows)
+
+	var place func(n *PedigreeNode, gen, pos int, role string)
+	place = func(n *PedigreeNode, gen, pos int, role string) {
+		if gen >= generations {
+			return
+		}
+		span := rows >> gen
+		row := pos * span
+		grid[row] = append(grid[row], pedigreeCell{Node: n, Rowspan: span, Role: role})
+		var sire, dam *PedigreeNode
+		if n != nil {
+			sire, dam = n.Sire, n.Dam
+		}
+		place(sire, gen+1, pos*2, "Sire")
+		place(dam, gen+1, pos*2+1, "Dam")
+	}
+	place(root, 0, 0, "")
+	return grid
+}
+
+// PedigreeCertificatePage renders a printable pedigree certificate with the
+// race performance of every ancestor (?generations=N, default 4).
+func PedigreeCertificatePage(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).SendString("Invalid pigeon id")
+		}
+		generations, err := pedigreeGenerations(c, 4)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		tree, err := loadPedigree(db, pigeonID, generations)
+		if err == sql.ErrNoRows {
+			return c.Status(404).SendString("Pigeon not found")
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		var owner string
+		err = db.QueryRow(`
+			SELECT COALESCE(u.full_name, u.username) FROM Pigeons p JOIN Users u ON u.user_id = p.user_id
+			WHERE p.pigeon_id = $1`, pigeonID).Scan(&owner)
+		if err != nil && err != sql.ErrNoRows {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Render("pedigree_certificate", fiber.Map{
+			"Pigeon":      tree,
+			"Owner":       owner,
+			"Generations": generations,
+			"Grid":        pedigreeGrid(tree, generations),
+		})
+	}
+}
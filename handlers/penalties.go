@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Penalty kinds
+const (
+	PenaltyDisqualify = "disqualification" // bird or loft is removed from the ranking
+	PenaltyTime       = "time"             // minutes added to the flying time
+	PenaltyPoints     = "points"           // championship points deducted
+)
+
+// penaltyReasons are the reason codes officers can give.
+var penaltyReasons = map[string]string{
+	"late_basketing":    "Bird basketed after basketing closed",
+	"wrong_ring":        "Ring does not match the registered bird",
+	"failed_inspection": "Bird or clock failed inspection",
+	"clock_tampering":   "Clock seal broken or clock tampered with",
+	"unsportsmanlike":   "Unsportsmanlike conduct",
+	"other":             "Other, see note",
+}
+
+// Penalty is imposed on one race entry (PigeonID) or on every entry of a
+// fancier's loft (UserID).
+type Penalty struct {
+	PenaltyID  int       `json:"penalty_id"`
+	RaceID     int       `json:"race_id"`
+	PigeonID   *int      `json:"pigeon_id"`
+	UserID     *int      `json:"user_id"`
+	ReasonCode string    `json:"reason_code"`
+	Kind       string    `json:"kind"`
+	Minutes    float64   `json:"minutes"`
+	Points     float64   `json:"points"`
+	Note       string    `json:"note"`
+	IssuedBy   int       `json:"issued_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// appliesTo reports whether the penalty covers a result line.
+func (p Penalty) appliesTo(l ResultLine) bool {
+	if p.PigeonID != nil {
+		return *p.PigeonID == l.PigeonID
+	}
+	return p.UserID != nil && *p.UserID == l.UserID
+}
+
+func loadRacePenalties(q queryer, raceID int) ([]Penalty, error) {
+	rows, err := q.Query(`
+		SELECT penalty_id, race_id, pigeon_id, user_id, reason_code, kind, minutes, points,
+			COALESCE(note, ''), issued_by, created_at
+		FROM Penalties WHERE race_id = $1
+		ORDER BY penalty_id
+	`, raceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	penalties := []Penalty{}
+	for rows.Next() {
+		var p Penalty
+		var pigeonID, userID sql.NullInt64
+		err := rows.Scan(&p.PenaltyID, &p.RaceID, &pigeonID, &userID, &p.ReasonCode, &p.Kind, &p.Minutes, &p.Points,
+			&p.Note, &p.IssuedBy, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		p.PigeonID, p.UserID = nullIntPtr(pigeonID), nullIntPtr(userID)
+		penalties = append(penalties, p)
+	}
+	return penalties, rows.Err()
+}
+
+// applyPenalties marks disqualified lines and adds time penalties to the
+// flying time before the lines are ranked.
+func applyPenalties(lines []ResultLine, penalties []Penalty) {
+	for i := range lines {
+		l := &lines[i]
+		for _, p := range penalties {
+			if !p.appliesTo(*l) {
+				continue
+			}
+			switch p.Kind {
+			case PenaltyDisqualify:
+				l.Disqualified = true
+			case PenaltyTime:
+				l.PenaltyMinutes += p.Minutes
+			}
+			if p.Kind != PenaltyPoints {
+				l.Penalties = append(l.Penalties, p.ReasonCode)
+			}
+		}
+		if l.PenaltyMinutes > 0 {
+			l.FlyingMinutes += l.PenaltyMinutes
+			l.SpeedKPH = 0
+			if l.FlyingMinutes > 0 {
+				l.SpeedKPH = l.DistanceKM / (l.FlyingMinutes / 60)
+			}
+		}
+	}
+}
+
+// applyPointPenalties records championship point deductions on result lines.
+// A bird penalty goes on that bird's line; a loft penalty goes on the loft's
+// best ranked line only so it is deducted once. A bird or loft without a
+// ranked line keeps its penalty in Penalties, and the standings deduct it
+// from there.
+func applyPointPenalties(lines []ResultLine, penalties []Penalty) {
+	for _, p := range penalties {
+		if p.Kind != PenaltyPoints {
+			continue
+		}
+		for i := range lines {
+			if lines[i].Disqualified || !p.appliesTo(lines[i]) {
+				continue
+			}
+			if p.PigeonID == nil && lines[i].Rank == 0 {
+				continue
+			}
+			if p.PigeonID == nil {
+				lines[i].LoftPenalty += p.Points
+			} else {
+				lines[i].PenaltyPoints += p.Points
+			}
+			lines[i].Penalties = append(lines[i].Penalties, p.ReasonCode)
+			if p.PigeonID == nil {
+				break // lines are in ranking order
+			}
+		}
+	}
+}
+
+// describePenalty is the penalty column of the printed result sheet.
+func describePenalty(l ResultLine) string {
+	var parts []string
+	if l.PenaltyMinutes > 0 {
+		parts = append(parts, fmt.Sprintf("+%g min", l.PenaltyMinutes))
+	}
+	if pts := l.PenaltyPoints + l.LoftPenalty; pts > 0 {
+		parts = append(parts, fmt.Sprintf("-%g pts", pts))
+	}
+	if len(l.Penalties) > 0 {
+		parts = append(parts, "("+strings.Join(l.Penalties, ", ")+")")
+	}
+	return strings.Join(parts, " ")
+}
+
+// =========================== PENALTIES ===========================
+
+// GetPenaltyReasonsHandler lists the penalty reason codes.
+func GetPenaltyReasonsHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(penaltyReasons)
+	}
+}
+
+// AddPenaltyHandler imposes a penalty on a race entry or on a fancier's loft.
+// It takes effect the next time the race results are computed.
+func AddPenaltyHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		var p Penalty
+		if err := c.BodyParser(&p); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if (p.PigeonID == nil) == (p.UserID == nil) {
+			return c.Status(400).JSON(fiber.Map{"error": "Give either pigeon_id (race entry) or user_id (whole loft)"})
+		}
+		if _, ok := penaltyReasons[p.ReasonCode]; !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "Unknown reason_code"})
+		}
+		if p.ReasonCode == "other" && p.Note == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "note is required for reason_code other"})
+		}
+		switch p.Kind {
+		case PenaltyDisqualify:
+			p.Minutes, p.Points = 0, 0
+		case PenaltyTime:
+			if p.Minutes <= 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "minutes must be positive for a time penalty"})
+			}
+			p.Points = 0
+		case PenaltyPoints:
+			if p.Points <= 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "points must be positive for a points penalty"})
+			}
+			p.Minutes = 0
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "kind must be disqualification, time or points"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		ok, err := isClubOfficer(tx, p.IssuedBy)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only club officers can impose penalties"})
+		}
+		if _, err := loadRaceInfo(tx, raceID); err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		} else if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if p.PigeonID != nil {
+			var entered bool
+			err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM RaceParticipants WHERE race_id = $1 AND pigeon_id = $2)`,
+				raceID, *p.PigeonID).Scan(&entered)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if !entered {
+				return c.Status(400).JSON(fiber.Map{"error": "Pigeon is not entered in this race"})
+			}
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO Penalties (race_id, pigeon_id, user_id, reason_code, kind, minutes, points, note, issued_by)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING penalty_id`,
+			raceID, p.PigeonID, p.UserID, p.ReasonCode, p.Kind, p.Minutes, p.Points, nullIfEmpty(p.Note), p.IssuedBy).Scan(&p.PenaltyID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		target := "loft of user"
+		targetID := p.UserID
+		if p.PigeonID != nil {
+			target, targetID = "pigeon", p.PigeonID
+		}
+		action := fmt.Sprintf("Penalty #%d: %s of %s %d in race %d (%s)", p.PenaltyID, p.Kind, target, *targetID, raceID, p.ReasonCode)
+		if err := logAudit(tx, p.IssuedBy, action); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Penalty recorded", "penalty_id": p.PenaltyID})
+	}
+}
+
+// GetRacePenaltiesHandler lists the penalties imposed in a race.
+func GetRacePenaltiesHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		penalties, err := loadRacePenalties(db, raceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(penalties)
+	}
+}
+
+// LiftPenaltyHandler removes a penalty, e.g. after a successful appeal.
+func LiftPenaltyHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			OfficerID int    `json:"officer_id"`
+			Reason    string `json:"reason"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.Reason == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "reason is required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		ok, err := isClubOfficer(tx, input.OfficerID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only club officers can lift penalties"})
+		}
+
+		var penaltyID, raceID int
+		err = tx.QueryRow(`DELETE FROM Penalties WHERE penalty_id = $1 RETURNING penalty_id, race_id`, c.Params("id")).Scan(&penaltyID, &raceID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Penalty not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := logAudit(tx, input.OfficerID, fmt.Sprintf("Penalty #%d in race %d lifted: %s", penaltyID, raceID, input.Reason)); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Penalty lifted"})
+	}
+}
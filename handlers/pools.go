@@ -0,0 +1,487 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Pool statuses
+const (
+	PoolOpen     = "open"
+	PoolSettled  = "settled"
+	PoolRefunded = "refunded" // the race was cancelled and every stake returned
+)
+
+// Pool ledger entry kinds
+const (
+	LedgerStake     = "stake"
+	LedgerDeduction = "deduction"
+	LedgerPayout    = "payout"
+	LedgerRefund    = "refund"
+)
+
+// Pool is a nomination pool run on one race.
+type Pool struct {
+	PoolID         int       `json:"pool_id"`
+	RaceID         int       `json:"race_id"`
+	Name           string    `json:"name"`
+	Stake          float64   `json:"stake"`           // per nominated bird
+	MaxNominations int       `json:"max_nominations"` // per fancier, e.g. 2 out of 10 basketed
+	PayoutPlaces   int       `json:"payout_places"`
+	PayoutSplit    []float64 `json:"payout_split"` // % of the pool per place, empty for linear
+	DeductionPct   float64   `json:"deduction_pct"`
+	Status         string    `json:"status"`
+}
+
+type PoolNomination struct {
+	NominationID int     `json:"nomination_id"`
+	UserID       int     `json:"user_id"`
+	Fancier      string  `json:"fancier"`
+	PigeonID     int     `json:"pigeon_id"`
+	RingNumber   string  `json:"ring_number"`
+	Stake        float64 `json:"stake"`
+	RaceRank     int     `json:"race_rank"` // 0 if not classified
+	Place        int     `json:"place"`     // place within the pool once settled
+	Payout       float64 `json:"payout"`
+}
+
+type PoolLedgerEntry struct {
+	EntryID   int     `json:"entry_id"`
+	UserID    int     `json:"user_id"`
+	PigeonID  int     `json:"pigeon_id"`
+	Kind      string  `json:"kind"`
+	Amount    float64 `json:"amount"`
+	CreatedAt string  `json:"created_at"`
+}
+
+func loadPool(q queryer, poolID int) (Pool, error) {
+	return scanPool(q, `
+		SELECT pool_id, race_id, name, stake, max_nominations, payout_places, payout_split, deduction_pct, status
+		FROM Pools WHERE pool_id = $1`, poolID)
+}
+
+// lockPool loads a pool and locks it until the transaction ends, so two
+// requests cannot both act on an open pool.
+func lockPool(tx *sql.Tx, poolID int) (Pool, error) {
+	return scanPool(tx, `
+		SELECT pool_id, race_id, name, stake, max_nominations, payout_places, payout_split, deduction_pct, status
+		FROM Pools WHERE pool_id = $1
+		FOR UPDATE`, poolID)
+}
+
+func scanPool(q queryer, query string, poolID int) (Pool, error) {
+	var p Pool
+	var split []byte
+	err := q.QueryRow(query, poolID).Scan(&p.PoolID, &p.RaceID, &p.Name, &p.Stake, &p.MaxNominations, &p.PayoutPlaces, &split, &p.DeductionPct, &p.Status)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(split, &p.PayoutSplit)
+	return p, err
+}
+
+// =========================== POOLS ===========================
+func CreatePoolHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		var p Pool
+		if err := c.BodyParser(&p); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if p.Name == "" || p.Stake <= 0 || p.MaxNominations <= 0 || p.PayoutPlaces <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "name, stake, max_nominations and payout_places are required"})
+		}
+		if len(p.PayoutSplit) > 0 && len(p.PayoutSplit) != p.PayoutPlaces {
+			return c.Status(400).JSON(fiber.Map{"error": "payout_split must have one percentage per payout place"})
+		}
+		if p.DeductionPct < 0 || p.DeductionPct > 100 {
+			return c.Status(400).JSON(fiber.Map{"error": "deduction_pct must be between 0 and 100"})
+		}
+		if err := validatePercentages("payout_split", p.PayoutSplit); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if p.PayoutSplit == nil {
+			p.PayoutSplit = []float64{}
+		}
+		split, _ := json.Marshal(p.PayoutSplit)
+
+		var poolID int
+		err = db.QueryRow(`
+			INSERT INTO Pools (race_id, name, stake, max_nominations, payout_places, payout_split, deduction_pct)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING pool_id`,
+			raceID, p.Name, p.Stake, p.MaxNominations, p.PayoutPlaces, split, p.DeductionPct).Scan(&poolID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Pool created", "pool_id": poolID})
+	}
+}
+
+// NominatePoolHandler records a fancier's nominations at basketing. Every bird
+// must belong to the fancier and be entered in the pool's race, and the
+// fancier may not exceed the pool's nomination limit. Nominations close when
+// the race is released.
+func NominatePoolHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		poolID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pool id"})
+		}
+		var input struct {
+			UserID    int   `json:"user_id"`
+			PigeonIDs []int `json:"pigeon_ids"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.UserID == 0 || len(input.PigeonIDs) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "user_id and pigeon_ids are required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		pool, err := lockPool(tx, poolID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pool not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if pool.Status != PoolOpen {
+			return c.Status(409).JSON(fiber.Map{"error": "Pool is already " + pool.Status})
+		}
+		var raceStatus string
+		if err := tx.QueryRow(`SELECT status FROM Races WHERE race_id = $1`, pool.RaceID).Scan(&raceStatus); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if raceStatus != RaceScheduled && raceStatus != RacePostponed {
+			return c.Status(409).JSON(fiber.Map{"error": "Nominations are closed: the race is " + raceStatus})
+		}
+
+		var existing int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM PoolNominations WHERE pool_id = $1 AND user_id = $2`, poolID, input.UserID).Scan(&existing); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if existing+len(input.PigeonIDs) > pool.MaxNominations {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("At most %d nominations per fancier (%d already made)", pool.MaxNominations, existing)})
+		}
+
+		for _, pigeonID := range input.PigeonIDs {
+			var ok bool
+			err := tx.QueryRow(`
+				SELECT EXISTS (
+					SELECT 1 FROM RaceParticipants rp
+					JOIN Races r ON r.race_id = rp.race_id
+					WHERE rp.race_id = $1 AND rp.pigeon_id = $2
+						AND pigeon_owner_at(rp.pigeon_id, r.release_time) = $3
+				)`, pool.RaceID, pigeonID, input.UserID).Scan(&ok)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if !ok {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Pigeon %d is not basketed for this race by user %d", pigeonID, input.UserID)})
+			}
+
+			_, err = tx.Exec(`INSERT INTO PoolNominations (pool_id, user_id, pigeon_id, stake) VALUES ($1, $2, $3, $4)`,
+				poolID, input.UserID, pigeonID, pool.Stake)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			_, err = tx.Exec(`INSERT INTO PoolLedger (pool_id, user_id, pigeon_id, kind, amount) VALUES ($1, $2, $3, $4, $5)`,
+				poolID, input.UserID, pigeonID, LedgerStake, pool.Stake)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Nominations recorded"})
+	}
+}
+
+// loadPoolNominations returns a pool's nominations ordered by race ranking,
+// unclassified birds last.
+func loadPoolNominations(q queryer, pool Pool) ([]PoolNomination, error) {
+	rows, err := q.Query(`
+		SELECT n.nomination_id, n.user_id, COALESCE(u.full_name, u.username), n.pigeon_id, p.ring_number, n.stake,
+			COALESCE(rr.rank, 0), n.place, n.payout
+		FROM PoolNominations n
+		JOIN Pigeons p ON p.pigeon_id = n.pigeon_id
+		JOIN Users u ON u.user_id = n.user_id
+		LEFT JOIN RaceResults rr ON rr.race_id = $2 AND rr.pigeon_id = n.pigeon_id
+		WHERE n.pool_id = $1
+		ORDER BY rr.rank IS NULL, rr.rank, n.nomination_id
+	`, pool.PoolID, pool.RaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []PoolNomination{}
+	for rows.Next() {
+		var n PoolNomination
+		if err := rows.Scan(&n.NominationID, &n.UserID, &n.Fancier, &n.PigeonID, &n.RingNumber, &n.Stake, &n.RaceRank, &n.Place, &n.Payout); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// poolPayouts splits the pool over the best PayoutPlaces classified nominations.
+func poolPayouts(pool Pool, nominations []PoolNomination) (deduction float64, payouts []float64) {
+	var total float64
+	for _, n := range nominations {
+		total += n.Stake
+	}
+	deduction = roundCents(total * pool.DeductionPct / 100)
+	net := total - deduction
+
+	places := 0
+	for _, n := range nominations {
+		if n.RaceRank > 0 && places < pool.PayoutPlaces {
+			places++
+		}
+	}
+	if places == 0 {
+		return deduction, nil
+	}
+
+	payouts = make([]float64, places)
+	if len(pool.PayoutSplit) > 0 {
+		// Unclaimed places are shared out over the places that were won.
+		var used float64
+		for i := 0; i < places; i++ {
+			used += pool.PayoutSplit[i]
+		}
+		for i := range payouts {
+			payouts[i] = roundCents(net * pool.PayoutSplit[i] / used)
+		}
+		return deduction, payouts
+	}
+	shares := places * (places + 1) / 2
+	for i := range payouts {
+		payouts[i] = roundCents(net * float64(places-i) / float64(shares))
+	}
+	return deduction, payouts
+}
+
+// SettlePoolHandler computes the pool winners from the race's official
+// ranking and writes the payouts to the pool ledger.
+func SettlePoolHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		poolID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pool id"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		pool, err := lockPool(tx, poolID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pool not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if pool.Status != PoolOpen {
+			return c.Status(409).JSON(fiber.Map{"error": "Pool is already " + pool.Status})
+		}
+		var raceStatus string
+		if err := tx.QueryRow(`SELECT status FROM Races WHERE race_id = $1`, pool.RaceID).Scan(&raceStatus); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if raceStatus == RaceCancelled {
+			return c.Status(409).JSON(fiber.Map{"error": "The pool's race was cancelled"})
+		}
+		var official bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ResultRevisions WHERE race_id = $1 AND official)`, pool.RaceID).Scan(&official); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !official {
+			return c.Status(409).JSON(fiber.Map{"error": "The race has no official results yet"})
+		}
+
+		nominations, err := loadPoolNominations(tx, pool)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		deduction, payouts := poolPayouts(pool, nominations)
+
+		if deduction > 0 {
+			_, err = tx.Exec(`INSERT INTO PoolLedger (pool_id, kind, amount) VALUES ($1, $2, $3)`, poolID, LedgerDeduction, -deduction)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		for i, amount := range payouts {
+			n := nominations[i]
+			_, err = tx.Exec(`UPDATE PoolNominations SET place = $1, payout = $2 WHERE nomination_id = $3`, i+1, amount, n.NominationID)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			_, err = tx.Exec(`INSERT INTO PoolLedger (pool_id, user_id, pigeon_id, kind, amount) VALUES ($1, $2, $3, $4, $5)`,
+				poolID, n.UserID, n.PigeonID, LedgerPayout, -amount)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		if _, err := tx.Exec(`UPDATE Pools SET status = $1, settled_at = NOW() WHERE pool_id = $2`, PoolSettled, poolID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Pool settled", "deduction": deduction, "payouts": payouts})
+	}
+}
+
+// refundRacePools returns every stake of the open pools on a race, e.g. when
+// the race is cancelled, and closes the pools. It returns the pools refunded.
+func refundRacePools(tx *sql.Tx, raceID int) (int, error) {
+	rows, err := tx.Query(`SELECT pool_id FROM Pools WHERE race_id = $1 AND status = $2 ORDER BY pool_id FOR UPDATE`, raceID, PoolOpen)
+	if err != nil {
+		return 0, err
+	}
+	var poolIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		poolIDs = append(poolIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, poolID := range poolIDs {
+		_, err := tx.Exec(`
+			INSERT INTO PoolLedger (pool_id, user_id, pigeon_id, kind, amount)
+			SELECT pool_id, user_id, pigeon_id, $2, -stake FROM PoolNominations WHERE pool_id = $1
+			ORDER BY nomination_id`, poolID, LedgerRefund)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE Pools SET status = $1, settled_at = NOW() WHERE pool_id = $2`, PoolRefunded, poolID); err != nil {
+			return 0, err
+		}
+	}
+	return len(poolIDs), nil
+}
+
+func loadPoolLedger(q queryer, poolID int) ([]PoolLedgerEntry, error) {
+	rows, err := q.Query(`
+		SELECT entry_id, COALESCE(user_id, 0), COALESCE(pigeon_id, 0), kind, amount, created_at
+		FROM PoolLedger WHERE pool_id = $1
+		ORDER BY entry_id
+	`, poolID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ledger := []PoolLedgerEntry{}
+	for rows.Next() {
+		var e PoolLedgerEntry
+		if err := rows.Scan(&e.EntryID, &e.UserID, &e.PigeonID, &e.Kind, &e.Amount, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		ledger = append(ledger, e)
+	}
+	return ledger, rows.Err()
+}
+
+// loadPoolSheet gathers everything shown for a pool.
+func loadPoolSheet(db *sql.DB, poolID int) (fiber.Map, error) {
+	pool, err := loadPool(db, poolID)
+	if err != nil {
+		return nil, err
+	}
+	nominations, err := loadPoolNominations(db, pool)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := loadPoolLedger(db, poolID)
+	if err != nil {
+		return nil, err
+	}
+
+	var raceName string
+	if err := db.QueryRow(`SELECT name FROM Races WHERE race_id = $1`, pool.RaceID).Scan(&raceName); err != nil {
+		return nil, err
+	}
+	var balance float64
+	for _, e := range ledger {
+		balance += e.Amount
+	}
+	return fiber.Map{
+		"Pool":        pool,
+		"RaceName":    raceName,
+		"Nominations": nominations,
+		"Ledger":      ledger,
+		"Balance":     roundCents(balance),
+	}, nil
+}
+
+func GetPoolHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		poolID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pool id"})
+		}
+		sheet, err := loadPoolSheet(db, poolID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pool not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{
+			"pool":        sheet["Pool"],
+			"race_name":   sheet["RaceName"],
+			"nominations": sheet["Nominations"],
+			"ledger":      sheet["Ledger"],
+			"balance":     sheet["Balance"],
+		})
+	}
+}
+
+// PoolSheetPage renders a pool's nominations and payouts as a printable sheet.
+func PoolSheetPage(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		poolID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).SendString("Invalid pool id")
+		}
+		sheet, err := loadPoolSheet(db, poolID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).SendString("Pool not found")
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Render("pool_sheet", sheet)
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// PrizeList is the prize money of a race and how it is split over the
+// prize-winning positions.
+type PrizeList struct {
+	Basketed   int       `json:"basketed"`
+	PrizeRatio int       `json:"prize_ratio"`
+	PrizeCount int       `json:"prize_count"`
+	EntryFees  float64   `json:"entry_fees"`
+	Sponsors   float64   `json:"sponsors"`
+	Deduction  float64   `json:"deduction"`
+	Pool       float64   `json:"pool"`
+	Amounts    []float64 `json:"amounts"` // Amounts[i] is paid to position i+1
+}
+
+// computePrizeList works out the prize pool of a race: entry fees for every
+// basketed bird (refunded and carried-over entries do not count) plus sponsor money, less the club deduction. One in
+// PrizeRatio basketed birds wins a prize. The pool is split by the race's
+// prize_split percentages when set, otherwise linearly (the winner gets
+// prize_count shares, the last prize one share).
+func computePrizeList(q queryer, race raceInfo) (PrizeList, error) {
+	pl := PrizeList{PrizeRatio: race.PrizeRatio}
+
+	if err := q.QueryRow(`SELECT COUNT(*) FROM RaceParticipants WHERE race_id = $1 AND status = $2`, race.RaceID, EntryEntered).Scan(&pl.Basketed); err != nil {
+		return pl, err
+	}
+	if err := q.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM RaceSponsors WHERE race_id = $1`, race.RaceID).Scan(&pl.Sponsors); err != nil {
+		return pl, err
+	}
+
+	pl.EntryFees = race.EntryFee * float64(pl.Basketed)
+	pl.Deduction = roundCents((pl.EntryFees + pl.Sponsors) * race.DeductionPct / 100)
+	pl.Pool = pl.EntryFees + pl.Sponsors - pl.Deduction
+
+	if race.PrizeRatio <= 0 || pl.Basketed == 0 {
+		return pl, nil
+	}
+	pl.PrizeCount = int(math.Ceil(float64(pl.Basketed) / float64(race.PrizeRatio)))
+
+	pl.Amounts = make([]float64, pl.PrizeCount)
+	if len(race.PrizeSplit) > 0 {
+		for i := range pl.Amounts {
+			if i < len(race.PrizeSplit) {
+				pl.Amounts[i] = roundCents(pl.Pool * race.PrizeSplit[i] / 100)
+			}
+		}
+		return pl, nil
+	}
+
+	shares := pl.PrizeCount * (pl.PrizeCount + 1) / 2
+	for i := range pl.Amounts {
+		pl.Amounts[i] = roundCents(pl.Pool * float64(pl.PrizeCount-i) / float64(shares))
+	}
+	return pl, nil
+}
+
+// applyPrizes marks the prize-winning lines of a ranking and sets their amount.
+func applyPrizes(lines []ResultLine, pl PrizeList) {
+	for i := range lines {
+		rank := lines[i].Rank
+		if rank > 0 && rank <= pl.PrizeCount {
+			lines[i].Prize = true
+			lines[i].PrizeAmount = pl.Amounts[rank-1]
+		}
+	}
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// validatePercentages checks that a split of money never pays out more than
+// the whole: no negative share and at most 100% in total.
+func validatePercentages(field string, pcts []float64) error {
+	var total float64
+	for _, p := range pcts {
+		if p < 0 {
+			return fmt.Errorf("%s cannot contain negative percentages", field)
+		}
+		total += p
+	}
+	if total > 100 {
+		return fmt.Errorf("%s adds up to %.2f%%, more than 100%%", field, total)
+	}
+	return nil
+}
+
+// GetRacePrizesHandler returns the prize pool breakdown of a race.
+func GetRacePrizesHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		race, err := loadRaceInfo(db, raceID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		pl, err := computePrizeList(db, race)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(pl)
+	}
+}
+
+// AddRaceSponsorHandler records a sponsor contribution to a race's prize pool.
+func AddRaceSponsorHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var s struct {
+			SponsorName string  `json:"sponsor_name"`
+			Amount      float64 `json:"amount"`
+		}
+		if err := c.BodyParser(&s); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if s.SponsorName == "" || s.Amount <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "sponsor_name and a positive amount are required"})
+		}
+		_, err := db.Exec(`INSERT INTO RaceSponsors (race_id, sponsor_name, amount) VALUES ($1, $2, $3)`,
+			c.Params("id"), s.SponsorName, s.Amount)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Sponsor added"})
+	}
+}
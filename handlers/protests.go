@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Protest statuses
+const (
+	ProtestOpen      = "open"
+	ProtestUpheld    = "upheld"
+	ProtestDismissed = "dismissed"
+)
+
+// Protest is a fancier's dispute of a race result or of one clocking.
+type Protest struct {
+	ProtestID    int               `json:"protest_id"`
+	RaceID       int               `json:"race_id"`
+	ClockingID   *int              `json:"clocking_id"`
+	FiledBy      int               `json:"filed_by"`
+	Grounds      string            `json:"grounds"`
+	Status       string            `json:"status"`
+	DecidedBy    *int              `json:"decided_by"`
+	DecisionNote string            `json:"decision_note"`
+	DecidedAt    *time.Time        `json:"decided_at"`
+	RevisionNo   *int              `json:"revision_no"` // result revision produced by an upheld protest
+	CreatedAt    time.Time         `json:"created_at"`
+	Evidence     []ProtestEvidence `json:"evidence"`
+}
+
+// ProtestEvidence is a reference to a photo, document or statement backing a
+// protest. Files themselves live in the club's document storage.
+type ProtestEvidence struct {
+	EvidenceID  int       `json:"evidence_id"`
+	Kind        string    `json:"kind"` // photo | document | video | statement
+	Reference   string    `json:"reference"`
+	Description string    `json:"description"`
+	AddedBy     int       `json:"added_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func validEvidenceKind(kind string) bool {
+	switch kind {
+	case "photo", "document", "video", "statement":
+		return true
+	}
+	return false
+}
+
+func loadProtest(q queryer, protestID int) (Protest, error) {
+	var p Protest
+	var clockingID, decidedBy, revisionNo sql.NullInt64
+	var decidedAt sql.NullTime
+	err := q.QueryRow(`
+		SELECT p.protest_id, p.race_id, p.clocking_id, p.filed_by, p.grounds, p.status,
+			p.decided_by, COALESCE(p.decision_note, ''), p.decided_at, rv.revision_no, p.created_at
+		FROM Protests p
+		LEFT JOIN ResultRevisions rv ON rv.protest_id = p.protest_id
+		WHERE p.protest_id = $1
+	`, protestID).Scan(&p.ProtestID, &p.RaceID, &clockingID, &p.FiledBy, &p.Grounds, &p.Status,
+		&decidedBy, &p.DecisionNote, &decidedAt, &revisionNo, &p.CreatedAt)
+	if err != nil {
+		return p, err
+	}
+	if clockingID.Valid {
+		id := int(clockingID.Int64)
+		p.ClockingID = &id
+	}
+	if decidedBy.Valid {
+		id := int(decidedBy.Int64)
+		p.DecidedBy = &id
+	}
+	if decidedAt.Valid {
+		p.DecidedAt = &decidedAt.Time
+	}
+	if revisionNo.Valid {
+		no := int(revisionNo.Int64)
+		p.RevisionNo = &no
+	}
+
+	rows, err := q.Query(`
+		SELECT evidence_id, kind, reference, COALESCE(description, ''), added_by, created_at
+		FROM ProtestEvidence WHERE protest_id = $1
+		ORDER BY evidence_id
+	`, protestID)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+
+	p.Evidence = []ProtestEvidence{}
+	for rows.Next() {
+		var e ProtestEvidence
+		if err := rows.Scan(&e.EvidenceID, &e.Kind, &e.Reference, &e.Description, &e.AddedBy, &e.CreatedAt); err != nil {
+			return p, err
+		}
+		p.Evidence = append(p.Evidence, e)
+	}
+	return p, rows.Err()
+}
+
+// =========================== PROTESTS ===========================
+
+// FileProtestHandler files a protest against a race, or against one of its
+// clockings when clocking_id is given.
+func FileProtestHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		var input struct {
+			ClockingID *int              `json:"clocking_id"`
+			FiledBy    int               `json:"filed_by"`
+			Grounds    string            `json:"grounds"`
+			Evidence   []ProtestEvidence `json:"evidence"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.FiledBy == 0 || input.Grounds == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "filed_by and grounds are required"})
+		}
+		for _, e := range input.Evidence {
+			if !validEvidenceKind(e.Kind) || e.Reference == "" {
+				return c.Status(400).JSON(fiber.Map{"error": "evidence needs a kind (photo, document, video or statement) and a reference"})
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		race, err := loadRaceInfo(tx, raceID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if race.Status == RaceCancelled {
+			return c.Status(409).JSON(fiber.Map{"error": "Race is cancelled"})
+		}
+
+		// Only a fancier with a bird in the race, or an officer, may protest.
+		var entitled bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM RaceParticipants rp
+				JOIN Races r ON r.race_id = rp.race_id
+				WHERE rp.race_id = $1 AND rp.status = $2
+					AND pigeon_owner_at(rp.pigeon_id, r.release_time) = $3
+			) OR EXISTS (SELECT 1 FROM Users WHERE user_id = $3 AND role IN ('admin', 'officer'))`,
+			raceID, EntryEntered, input.FiledBy).Scan(&entitled)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !entitled {
+			return c.Status(403).JSON(fiber.Map{"error": "Only fanciers with a bird in the race or officers can file a protest"})
+		}
+		if input.ClockingID != nil {
+			var ok bool
+			err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Clockings WHERE clocking_id = $1 AND race_id = $2)`,
+				*input.ClockingID, raceID).Scan(&ok)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if !ok {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Clocking %d is not part of this race", *input.ClockingID)})
+			}
+		}
+
+		var protestID int
+		err = tx.QueryRow(`
+			INSERT INTO Protests (race_id, clocking_id, filed_by, grounds)
+			VALUES ($1, $2, $3, $4)
+			RETURNING protest_id`,
+			raceID, input.ClockingID, input.FiledBy, input.Grounds).Scan(&protestID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		for _, e := range input.Evidence {
+			_, err := tx.Exec(`INSERT INTO ProtestEvidence (protest_id, kind, reference, description, added_by) VALUES ($1, $2, $3, $4, $5)`,
+				protestID, e.Kind, e.Reference, nullIfEmpty(e.Description), input.FiledBy)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Protest filed", "protest_id": protestID})
+	}
+}
+
+// AddProtestEvidenceHandler attaches more evidence to an open protest. Only
+// the protester, the owner of the protested clocking's bird and officers may
+// add evidence.
+func AddProtestEvidenceHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var e ProtestEvidence
+		if err := c.BodyParser(&e); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if !validEvidenceKind(e.Kind) || e.Reference == "" || e.AddedBy == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "kind (photo, document, video or statement), reference and added_by are required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		// Lock the protest so it cannot be decided while evidence is added.
+		var status string
+		var party bool
+		err = tx.QueryRow(`
+			SELECT p.status,
+				p.filed_by = $2
+				OR EXISTS (SELECT 1 FROM Users WHERE user_id = $2 AND role IN ('admin', 'officer'))
+				OR EXISTS (
+					SELECT 1 FROM Clockings cl
+					JOIN Races r ON r.race_id = cl.race_id
+					WHERE cl.clocking_id = p.clocking_id AND pigeon_owner_at(cl.pigeon_id, r.release_time) = $2
+				)
+			FROM Protests p WHERE p.protest_id = $1
+			FOR SHARE OF p`, c.Params("id"), e.AddedBy).Scan(&status, &party)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Protest not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if status != ProtestOpen {
+			return c.Status(409).JSON(fiber.Map{"error": "Protest already decided"})
+		}
+		if !party {
+			return c.Status(403).JSON(fiber.Map{"error": "Only the protester, the accused owner or an officer can add evidence"})
+		}
+
+		var evidenceID int
+		err = tx.QueryRow(`
+			INSERT INTO ProtestEvidence (protest_id, kind, reference, description, added_by)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING evidence_id`,
+			c.Params("id"), e.Kind, e.Reference, nullIfEmpty(e.Description), e.AddedBy).Scan(&evidenceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Evidence added", "evidence_id": evidenceID})
+	}
+}
+
+// DecideProtestHandler records the committee's decision on a protest. An
+// upheld protest against a clocking may set that clocking's status; either
+// way an upheld protest recomputes the race results as a new provisional
+// revision, to be published by an officer.
+func DecideProtestHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		protestID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid protest id"})
+		}
+		var input struct {
+			DecidedBy      int    `json:"decided_by"`
+			Decision       string `json:"decision"` // upheld | dismissed
+			Note           string `json:"note"`
+			ClockingStatus string `json:"clocking_status"` // optional: accepted | rejected
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.Decision != ProtestUpheld && input.Decision != ProtestDismissed {
+			return c.Status(400).JSON(fiber.Map{"error": "decision must be upheld or dismissed"})
+		}
+		if input.ClockingStatus != "" && input.ClockingStatus != ClockingAccepted && input.ClockingStatus != ClockingRejected {
+			return c.Status(400).JSON(fiber.Map{"error": "clocking_status must be accepted or rejected"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		ok, err := isClubOfficer(tx, input.DecidedBy)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only club officers can decide protests"})
+		}
+
+		p, err := loadProtest(tx, protestID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Protest not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if p.Status != ProtestOpen {
+			return c.Status(409).JSON(fiber.Map{"error": "Protest already decided"})
+		}
+
+		// The status guard makes a concurrent second decision update nothing.
+		res, err := tx.Exec(`
+			UPDATE Protests SET status = $1, decided_by = $2, decision_note = $3, decided_at = NOW()
+			WHERE protest_id = $4 AND status = $5`,
+			input.Decision, input.DecidedBy, nullIfEmpty(input.Note), protestID, ProtestOpen)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return c.Status(409).JSON(fiber.Map{"error": "Protest already decided"})
+		}
+
+		resp := fiber.Map{"message": "Protest " + input.Decision}
+		if input.Decision == ProtestUpheld {
+			if input.ClockingStatus != "" {
+				if p.ClockingID == nil {
+					return c.Status(400).JSON(fiber.Map{"error": "clocking_status only applies to protests against a clocking"})
+				}
+				res, err := tx.Exec(`
+					UPDATE Clockings SET status = $1, reviewed_by = $2, reviewed_at = NOW()
+					WHERE clocking_id = $3 AND status <> $4`,
+					input.ClockingStatus, input.DecidedBy, *p.ClockingID, ClockingInvalidated)
+				if err != nil {
+					return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+				}
+				if n, _ := res.RowsAffected(); n == 0 {
+					return c.Status(409).JSON(fiber.Map{"error": "The clocking was invalidated by a race status change and cannot be reinstated"})
+				}
+			}
+			rev, err := recomputeRaceResults(tx, p.RaceID, fmt.Sprintf("protest #%d upheld", protestID), &input.DecidedBy, &protestID)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			resp["revision_no"] = rev.RevisionNo
+			resp["results"] = rev.Results
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(resp)
+	}
+}
+
+// GetProtestHandler returns a protest with its evidence and decision.
+func GetProtestHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		protestID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid protest id"})
+		}
+		p, err := loadProtest(db, protestID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Protest not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(p)
+	}
+}
+
+// GetRaceProtestsHandler lists the protests filed against a race.
+func GetRaceProtestsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`SELECT protest_id FROM Protests WHERE race_id = $1 ORDER BY protest_id`, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		protests := []Protest{}
+		for _, id := range ids {
+			p, err := loadProtest(db, id)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			protests = append(protests, p)
+		}
+		return c.JSON(protests)
+	}
+}
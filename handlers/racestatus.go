@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hvm_clocking/events"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Race statuses
+const (
+	RaceScheduled = "scheduled"
+	RacePostponed = "postponed" // moved to another day or release site, not yet released
+	RaceReleased  = "released"
+	RaceCancelled = "cancelled"
+)
+
+// Entry statuses
+const (
+	EntryEntered     = "entered"
+	EntryCarriedOver = "carried_over" // moved to another race when this one was cancelled
+	EntryRefunded    = "refunded"
+)
+
+// basketError is why a pigeon may not be entered in a race.
+type basketError struct {
+	msg     string
+	Missing []string // vaccinations missing on race day
+}
+
+func (e *basketError) Error() string { return e.msg }
+
+// basketPigeon enters a pigeon in a race and publishes EntryAdded. The bird
+// must be at home and hold every vaccination its club requires on race day;
+// otherwise a *basketError is returned. It returns false when the bird was
+// already entered. Every way of entering a bird goes through here.
+func basketPigeon(tx *sql.Tx, raceID, pigeonID int) (bool, error) {
+	var ring, status string
+	if err := tx.QueryRow(`SELECT ring_number, status FROM Pigeons WHERE pigeon_id = $1`, pigeonID).Scan(&ring, &status); err != nil {
+		return false, err
+	}
+	if !canBasket(status) {
+		return false, &basketError{msg: fmt.Sprintf("Pigeon %s is %s and cannot be basketed", ring, status)}
+	}
+	missing, raceDay, err := missingVaccinations(tx, pigeonID, raceID)
+	if err != nil {
+		return false, err
+	}
+	if len(missing) > 0 {
+		return false, &basketError{msg: vaccinationError(ring, missing, raceDay), Missing: missing}
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO RaceParticipants (race_id, pigeon_id) VALUES ($1, $2)
+		ON CONFLICT (race_id, pigeon_id) DO NOTHING`, raceID, pigeonID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, events.Publish(tx, events.EntryAdded, events.EntryAddedPayload{RaceID: raceID, PigeonID: pigeonID})
+}
+
+// invalidateClockings marks the still-counting clockings of a race made before
+// cutoff (all of them when cutoff is empty) as invalidated.
+func invalidateClockings(q queryer, raceID int, cutoff string) (int64, error) {
+	res, err := q.Exec(`
+		UPDATE Clockings SET status = $1
+		WHERE race_id = $2 AND status <> $1 AND ($3::timestamp IS NULL OR arrival_time < $3::timestamp)`,
+		ClockingInvalidated, raceID, nullIfEmpty(cutoff))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// raceChange is the part every cancel, postpone and re-release request shares.
+type raceChange struct {
+	OfficerID int    `json:"officer_id"`
+	Reason    string `json:"reason"`
+}
+
+// beginRaceChange validates the officer and loads the race in a new
+// transaction. On failure it has already written the error response.
+func beginRaceChange(db *sql.DB, c *fiber.Ctx, in raceChange) (*sql.Tx, raceInfo, error) {
+	raceID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return nil, raceInfo{}, c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+	}
+	if in.Reason == "" {
+		return nil, raceInfo{}, c.Status(400).JSON(fiber.Map{"error": "reason is required"})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, raceInfo{}, c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+	}
+	fail := func(status int, msg string) (*sql.Tx, raceInfo, error) {
+		tx.Rollback()
+		return nil, raceInfo{}, c.Status(status).JSON(fiber.Map{"error": msg})
+	}
+
+	ok, err := isClubOfficer(tx, in.OfficerID)
+	if err != nil {
+		return fail(500, err.Error())
+	}
+	if !ok {
+		return fail(403, "Only club officers can change a race's status")
+	}
+	race, err := loadRaceInfo(tx, raceID)
+	if err == sql.ErrNoRows {
+		return fail(404, "Race not found")
+	}
+	if err != nil {
+		return fail(500, err.Error())
+	}
+	if race.Status == RaceCancelled {
+		return fail(409, "Race is cancelled")
+	}
+	return tx, race, nil
+}
+
+// =========================== RACE STATUS ===========================
+
+// CancelRaceHandler cancels a race. Entries are refunded the entry fee or
+// carried over to a race that has not been released yet; a bird that could
+// not be basketed for that race is refunded instead. Every clocking is
+// invalidated, any published results are withdrawn and open pools on the race
+// return their stakes.
+func CancelRaceHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			raceChange
+			Entries     string `json:"entries"` // refund | carry_over
+			CarryOverTo int    `json:"carry_over_race_id"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.Entries != "refund" && input.Entries != "carry_over" {
+			return c.Status(400).JSON(fiber.Map{"error": "entries must be refund or carry_over"})
+		}
+		if input.Entries == "carry_over" && input.CarryOverTo == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "carry_over_race_id is required to carry entries over"})
+		}
+
+		tx, race, err := beginRaceChange(db, c, input.raceChange)
+		if tx == nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// Notify while the entries are still entered.
+		if err := notifyRaceParticipants(tx, race.RaceID, race.Name+" cancelled", input.Reason); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var moved int64
+		refused := []string{}
+		if input.Entries == "carry_over" {
+			target, err := loadRaceInfo(tx, input.CarryOverTo)
+			if err == sql.ErrNoRows || (err == nil && target.RaceID == race.RaceID) {
+				return c.Status(400).JSON(fiber.Map{"error": "carry_over_race_id must be another race"})
+			}
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if target.Status != RaceScheduled && target.Status != RacePostponed {
+				return c.Status(409).JSON(fiber.Map{"error": "Entries can only be carried over to a race that has not been released"})
+			}
+
+			rows, err := tx.Query(`SELECT pigeon_id FROM RaceParticipants WHERE race_id = $1 AND status = $2 ORDER BY pigeon_id`,
+				race.RaceID, EntryEntered)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			var pigeonIDs []int
+			for rows.Next() {
+				var id int
+				if err := rows.Scan(&id); err != nil {
+					rows.Close()
+					return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+				}
+				pigeonIDs = append(pigeonIDs, id)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+
+			// Birds that could not be basketed for the target race on its
+			// own day are refunded instead.
+			for _, pigeonID := range pigeonIDs {
+				entered, err := basketPigeon(tx, target.RaceID, pigeonID)
+				var be *basketError
+				if errors.As(err, &be) {
+					_, err := tx.Exec(`
+						UPDATE RaceParticipants SET status = $1, refund_amount = $2, refunded_at = NOW()
+						WHERE race_id = $3 AND pigeon_id = $4`,
+						EntryRefunded, race.EntryFee, race.RaceID, pigeonID)
+					if err != nil {
+						return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+					}
+					refused = append(refused, be.Error())
+					continue
+				}
+				if err != nil {
+					return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+				}
+				if entered {
+					moved++
+				}
+				_, err = tx.Exec(`UPDATE RaceParticipants SET status = $1, carried_to_race_id = $2 WHERE race_id = $3 AND pigeon_id = $4`,
+					EntryCarriedOver, target.RaceID, race.RaceID, pigeonID)
+				if err != nil {
+					return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+				}
+			}
+		} else {
+			res, err := tx.Exec(`
+				UPDATE RaceParticipants SET status = $1, refund_amount = $2, refunded_at = NOW()
+				WHERE race_id = $3 AND status = $4`,
+				EntryRefunded, race.EntryFee, race.RaceID, EntryEntered)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			moved, _ = res.RowsAffected()
+		}
+
+		invalidated, err := invalidateClockings(tx, race.RaceID, "")
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		_, err = tx.Exec(`UPDATE Races SET status = $1, status_reason = $2 WHERE race_id = $3`, RaceCancelled, input.Reason, race.RaceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// A cancelled race has no results: withdraw the published ones and
+		// let the standings drop the race.
+		if err := storeRaceResults(tx, race.RaceID, nil); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := storeTeamResults(tx, race.RaceID, nil); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if _, err := tx.Exec(`UPDATE ResultRevisions SET official = FALSE WHERE race_id = $1 AND official`, race.RaceID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		pools, err := refundRacePools(tx, race.RaceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		err = events.Publish(tx, events.RaceCancelled, events.RaceCancelledPayload{RaceID: race.RaceID, Reason: input.Reason})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		entries := "refunded"
+		if input.Entries == "carry_over" {
+			entries = fmt.Sprintf("carried over to race %d (%d refunded instead)", input.CarryOverTo, len(refused))
+		}
+		action := fmt.Sprintf("Race %d cancelled (%s): %d entries %s, %d clockings invalidated, %d pools refunded",
+			race.RaceID, input.Reason, moved, entries, invalidated, pools)
+		if err := logAudit(tx, input.OfficerID, action); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		resp := fiber.Map{"message": "Race cancelled", "entries": moved, "clockings_invalidated": invalidated, "pools_refunded": pools}
+		if input.Entries == "carry_over" {
+			resp["refunded"] = refused
+		}
+		return c.JSON(resp)
+	}
+}
+
+// PostponeRaceHandler moves a race that has not been released yet to another
+// day and optionally another release site. The original schedule is kept.
+// Entries stay, except birds whose vaccinations do not cover the new race
+// day, which are refunded; clockings made so far are invalidated.
+func PostponeRaceHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			raceChange
+			ReleaseTime string   `json:"release_time"` // YYYY-MM-DD HH:MM:SS
+			Location    string   `json:"location"`
+			ReleaseLat  *float64 `json:"release_lat"`
+			ReleaseLng  *float64 `json:"release_lng"`
+			DistanceKM  *float64 `json:"distance_km"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		release, err := parseTimestamp(input.ReleaseTime)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "release_time must be YYYY-MM-DD HH:MM:SS"})
+		}
+		if (input.ReleaseLat == nil) != (input.ReleaseLng == nil) {
+			return c.Status(400).JSON(fiber.Map{"error": "release_lat and release_lng go together"})
+		}
+
+		tx, race, err := beginRaceChange(db, c, input.raceChange)
+		if tx == nil {
+			return err
+		}
+		defer tx.Rollback()
+		if race.Status == RaceReleased {
+			return c.Status(409).JSON(fiber.Map{"error": "Race is already released; cancel or re-release it instead"})
+		}
+
+		releaseTime := release.Format(timestampLayout)
+		_, err = tx.Exec(`
+			UPDATE Races SET status = $1, status_reason = $2, release_time = $3,
+				scheduled_release_time = COALESCE(scheduled_release_time, release_time),
+				liberated_at = NULL, location = COALESCE($4, location),
+				release_lat = COALESCE($5, release_lat), release_lng = COALESCE($6, release_lng),
+				distance_km = COALESCE($7, distance_km)
+			WHERE race_id = $8`,
+			RacePostponed, input.Reason, releaseTime, nullIfEmpty(input.Location),
+			input.ReleaseLat, input.ReleaseLng, input.DistanceKM, race.RaceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		invalidated, err := invalidateClockings(tx, race.RaceID, "")
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		refunded, err := refundUnvaccinated(tx, race)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		site := ""
+		if input.Location != "" {
+			site = " from " + input.Location
+		}
+		action := fmt.Sprintf("Race %d postponed to %s%s (%s): %d clockings invalidated, %d entries refunded",
+			race.RaceID, releaseTime, site, input.Reason, invalidated, len(refunded))
+		if err := logAudit(tx, input.OfficerID, action); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		body := fmt.Sprintf("New release: %s%s. %s", releaseTime, site, input.Reason)
+		if err := notifyRaceParticipants(tx, race.RaceID, race.Name+" postponed", body); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Race postponed", "release_time": releaseTime, "clockings_invalidated": invalidated,
+			"refunded": refunded})
+	}
+}
+
+// refundUnvaccinated refunds the entries of a race whose birds no longer hold
+// every required vaccination on the race day, e.g. after a postponement, and
+// returns why each was refunded.
+func refundUnvaccinated(tx *sql.Tx, race raceInfo) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT rp.pigeon_id, p.ring_number
+		FROM RaceParticipants rp JOIN Pigeons p ON p.pigeon_id = rp.pigeon_id
+		WHERE rp.race_id = $1 AND rp.status = $2
+		ORDER BY rp.pigeon_id`, race.RaceID, EntryEntered)
+	if err != nil {
+		return nil, err
+	}
+	type entry struct {
+		pigeonID int
+		ring     string
+	}
+	var entries []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.pigeonID, &e.ring); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	refunded := []string{}
+	for _, e := range entries {
+		missing, raceDay, err := missingVaccinations(tx, e.pigeonID, race.RaceID)
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		_, err = tx.Exec(`
+			UPDATE RaceParticipants SET status = $1, refund_amount = $2, refunded_at = NOW()
+			WHERE race_id = $3 AND pigeon_id = $4`,
+			EntryRefunded, race.EntryFee, race.RaceID, e.pigeonID)
+		if err != nil {
+			return nil, err
+		}
+		refunded = append(refunded, vaccinationError(e.ring, missing, raceDay))
+	}
+	return refunded, nil
+}
+
+// ReReleaseRaceHandler records a second release of a race, e.g. after the
+// birds were recalled. Clockings with an arrival before the new release are
+// invalidated and the results are recomputed as a provisional revision.
+func ReReleaseRaceHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			raceChange
+			ReleaseTime string `json:"release_time"` // YYYY-MM-DD HH:MM:SS
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		release, err := parseTimestamp(input.ReleaseTime)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "release_time must be YYYY-MM-DD HH:MM:SS"})
+		}
+
+		tx, race, err := beginRaceChange(db, c, input.raceChange)
+		if tx == nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		releaseTime := release.Format(timestampLayout)
+		invalidated, err := invalidateClockings(tx, race.RaceID, releaseTime)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		_, err = tx.Exec(`
+			UPDATE Races SET status = $1, status_reason = $2, release_time = $3, liberated_at = NOW(),
+				scheduled_release_time = COALESCE(scheduled_release_time, release_time)
+			WHERE race_id = $4`,
+			RaceReleased, input.Reason, releaseTime, race.RaceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		action := fmt.Sprintf("Race %d re-released at %s (%s): %d clockings invalidated", race.RaceID, releaseTime, input.Reason, invalidated)
+		if err := logAudit(tx, input.OfficerID, action); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		resp := fiber.Map{"message": "Race re-released", "release_time": releaseTime, "clockings_invalidated": invalidated}
+
+		var clocked bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM Clockings WHERE race_id = $1 AND status <> $2)`, race.RaceID, ClockingInvalidated).Scan(&clocked); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if clocked {
+			rev, err := recomputeRaceResults(tx, race.RaceID, "re-released at "+releaseTime, &input.OfficerID, nil)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			resp["revision_no"] = rev.RevisionNo
+		}
+		if err := notifyRaceParticipants(tx, race.RaceID, race.Name+" re-released", fmt.Sprintf("Birds re-released at %s. %s", releaseTime, input.Reason)); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(resp)
+	}
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"strconv"
+
+	"hvm_clocking/readout"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Readout line outcomes
+const (
+	ReadoutMatched    = "matched"     // pigeon found and basketed; clocking recorded
+	ReadoutUnknown    = "unknown"     // no pigeon with this chip or ring number
+	ReadoutNotOwned   = "not_owned"   // pigeon belonged to another fancier at the release
+	ReadoutNotEntered = "not_entered" // pigeon is not basketed for the race
+	ReadoutImported   = "imported"    // identical clocking already on file
+	ReadoutRefused    = "refused"     // the clocking itself was refused, see Error
+)
+
+// ReadoutLine is what the importer made of one readout record.
+type ReadoutLine struct {
+	readout.Record
+	Outcome    string           `json:"outcome"`
+	PigeonID   int              `json:"pigeon_id,omitempty"`
+	RingNumber string           `json:"matched_ring,omitempty"`
+	Clocking   *clockingOutcome `json:"clocking,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+// ReadoutImport summarises a readout preview or import.
+type ReadoutImport struct {
+	Format     string              `json:"format"`
+	Committed  bool                `json:"committed"`
+	Matched    int                 `json:"matched"`
+	Mismatched int                 `json:"mismatched"`
+	Lines      []ReadoutLine       `json:"lines"`
+	Errors     []readout.LineError `json:"errors"`
+}
+
+// matchReadoutRecord finds the pigeon a readout record refers to and who
+// owned it at the race's release. Chip numbers take precedence over ring
+// numbers.
+func matchReadoutRecord(q queryer, raceID int, rec readout.Record) (pigeonID, ownerID int, ring string, err error) {
+	err = q.QueryRow(`
+		SELECT p.pigeon_id, pigeon_owner_at(p.pigeon_id, r.release_time), p.ring_number
+		FROM Pigeons p
+		JOIN Races r ON r.race_id = $3
+		WHERE ($1 <> '' AND p.chip_number = $1) OR ($2 <> '' AND UPPER(p.ring_number) = UPPER($2))
+		ORDER BY (p.chip_number = $1) IS TRUE DESC
+		LIMIT 1`, rec.ChipNumber, rec.RingNumber, raceID).Scan(&pigeonID, &ownerID, &ring)
+	return
+}
+
+// importReadout maps every record to a pigeon and records the matched ones
+// through recordClocking, so imported arrivals get the same rules, findings
+// and events as clockings sent one by one. Records already imported with the
+// same arrival time are skipped, which makes re-importing a file harmless.
+func importReadout(tx *sql.Tx, raceID, userID, deviceID int, records []readout.Record) ([]ReadoutLine, error) {
+	lines := make([]ReadoutLine, 0, len(records))
+	for _, rec := range records {
+		line := ReadoutLine{Record: rec}
+
+		pigeonID, ownerID, ring, err := matchReadoutRecord(tx, raceID, rec)
+		if err == sql.ErrNoRows {
+			line.Outcome = ReadoutUnknown
+			lines = append(lines, line)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line.PigeonID, line.RingNumber = pigeonID, ring
+
+		var entered, imported bool
+		err = tx.QueryRow(`
+			SELECT
+				EXISTS (SELECT 1 FROM RaceParticipants WHERE race_id = $1 AND pigeon_id = $2 AND status = $4),
+				EXISTS (SELECT 1 FROM Clockings WHERE race_id = $1 AND pigeon_id = $2 AND arrival_time = $3)`,
+			raceID, pigeonID, rec.Arrival.Format(timestampLayout), EntryEntered).Scan(&entered, &imported)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case userID != 0 && ownerID != userID:
+			line.Outcome = ReadoutNotOwned
+		case !entered:
+			line.Outcome = ReadoutNotEntered
+		case imported:
+			line.Outcome = ReadoutImported
+		}
+		if line.Outcome != "" {
+			lines = append(lines, line)
+			continue
+		}
+
+		out, err := recordClocking(tx, ClockingInput{
+			PigeonID: pigeonID,
+			RaceID:   raceID,
+			UserID:   ownerID,
+			DeviceID: deviceID,
+			Arrival:  rec.Arrival.Format(timestampLayout),
+		})
+		if errors.Is(err, errInvalidClocking) {
+			line.Outcome = ReadoutRefused
+			line.Error = err.Error()
+			lines = append(lines, line)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line.Outcome = ReadoutMatched
+		line.Clocking = &out
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// =========================== CLOCK READOUTS ===========================
+
+// ReadoutFormatsHandler lists the registered readout parsers.
+func ReadoutFormatsHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(readout.Formats())
+	}
+}
+
+// ImportReadoutHandler parses a clock readout uploaded as the multipart field
+// "file" (or as the raw request body) and records its arrivals for the race.
+// With commit=false nothing is kept: the import runs in a transaction that is
+// rolled back, so the preview shows exactly what an import would do.
+func ImportReadoutHandler(db *sql.DB, commit bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		param := func(name string) string {
+			if v := c.FormValue(name); v != "" {
+				return v
+			}
+			return c.Query(name)
+		}
+		format := param("format")
+		if format == "" {
+			format = "csv"
+		}
+		userID, _ := strconv.Atoi(param("user_id"))
+		deviceID, err := strconv.Atoi(param("device_id"))
+		if err != nil || deviceID == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "device_id is required"})
+		}
+
+		parser, err := readout.Get(format)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var body io.Reader = bytes.NewReader(c.Body())
+		if fh, err := c.FormFile("file"); err == nil {
+			f, err := fh.Open()
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Cannot read uploaded file"})
+			}
+			defer f.Close()
+			body = f
+		}
+
+		records, lineErrs, err := parser.Parse(body)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if lineErrs == nil {
+			lineErrs = []readout.LineError{}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		if _, err := loadRaceInfo(tx, raceID); err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		} else if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		lines, err := importReadout(tx, raceID, userID, deviceID, records)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		res := ReadoutImport{Format: format, Lines: lines, Errors: lineErrs}
+		for _, l := range lines {
+			if l.Outcome == ReadoutMatched {
+				res.Matched++
+			} else if l.Outcome != ReadoutImported {
+				res.Mismatched++
+			}
+		}
+
+		if commit {
+			if err := tx.Commit(); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+			}
+			res.Committed = true
+		}
+		return c.JSON(res)
+	}
+}
@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ResultLine is one ranked bird in a computed race result.
+type ResultLine struct {
+	Rank           int       `json:"rank"`
+	PigeonID       int       `json:"pigeon_id"`
+	RingNumber     string    `json:"ring_number"`
+	UserID         int       `json:"user_id"`
+	Fancier        string    `json:"fancier"`
+	ClockingID     int       `json:"clocking_id"`
+	Arrival        time.Time `json:"arrival_time"`
+	DistanceKM     float64   `json:"distance_km"`
+	FlyingMinutes  float64   `json:"flying_minutes"`
+	SpeedKPH       float64   `json:"speed_kph"`
+	OutsideRace    bool      `json:"outside_race"`
+	Disqualified   bool      `json:"disqualified"`
+	PenaltyMinutes float64   `json:"penalty_minutes"`
+	PenaltyPoints  float64   `json:"penalty_points"`      // on this bird
+	LoftPenalty    float64   `json:"loft_penalty_points"` // on the whole loft, carried by its best line
+	Penalties      []string  `json:"penalties,omitempty"` // reason codes
+	Prize          bool      `json:"prize"`
+	PrizeAmount    float64   `json:"prize_amount"`
+
+	LoftLat sql.NullFloat64 `json:"-"`
+	LoftLng sql.NullFloat64 `json:"-"`
+}
+
+// computeRaceResults ranks every counted clocking of a race by speed. The
+// clocking rules are run again first: new findings are stored, and clockings
+// an officer has not reviewed are quarantined or rejected per club policy.
+// Only accepted clockings are ranked, each credited to the fancier who owned
+// the bird at release. Velocity uses each loft's own distance
+// from the release point when both are known. Flying time excludes the neutralized
+// night hours; birds clocked after the race closed are listed after the
+// ranking with OutsideRace set and no rank. Penalties are applied before
+// ranking: disqualified birds are listed last without a rank, and time
+// penalties lengthen the flying time. Prize winners are marked from the
+// race's prize list.
+func computeRaceResults(tx *sql.Tx, raceID int) ([]ResultLine, error) {
+	race, err := loadRaceInfo(tx, raceID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT c.clocking_id, c.pigeon_id, c.arrival_time, c.status, c.reviewed_by IS NOT NULL,
+			p.ring_number, u.user_id, COALESCE(u.full_name, u.username), l.latitude, l.longitude
+		FROM Clockings c
+		JOIN Pigeons p ON p.pigeon_id = c.pigeon_id
+		JOIN Users u ON u.user_id = pigeon_owner_at(p.pigeon_id, $2)
+		LEFT JOIN LoftCoordinates l ON l.user_id = u.user_id
+		WHERE c.race_id = $1 AND c.status NOT IN ('rejected', 'invalidated')
+		ORDER BY c.clocking_id
+	`, raceID, race.ReleaseTime)
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		line     ResultLine
+		status   string
+		reviewed bool
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var cd candidate
+		err := rows.Scan(&cd.line.ClockingID, &cd.line.PigeonID, &cd.line.Arrival, &cd.status, &cd.reviewed,
+			&cd.line.RingNumber, &cd.line.UserID, &cd.line.Fancier, &cd.line.LoftLat, &cd.line.LoftLng)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, cd)
+	}
+	rows.Close()
+
+	var lines []ResultLine
+	linePos := map[int]int{} // pigeon -> its line in lines
+	for _, cd := range candidates {
+		findings, status, err := runClockingRules(tx, clockingCheck{
+			ClockingID: cd.line.ClockingID,
+			PigeonID:   cd.line.PigeonID,
+			RaceID:     raceID,
+			Arrival:    cd.line.Arrival,
+			Race:       race,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := saveFindings(tx, cd.line.ClockingID, findings); err != nil {
+			return nil, err
+		}
+
+		// An officer's review decision is final, and manual clockings wait
+		// for one; only accepted clockings are ranked.
+		if !cd.reviewed && cd.status != ClockingUnverified && status != ClockingAccepted && status != cd.status {
+			if _, err := tx.Exec(`UPDATE Clockings SET status = $1 WHERE clocking_id = $2`, status, cd.line.ClockingID); err != nil {
+				return nil, err
+			}
+			cd.status = status
+		}
+		if cd.status != ClockingAccepted {
+			continue
+		}
+
+		line := cd.line
+		line.DistanceKM = race.distanceTo(line.LoftLat, line.LoftLng)
+		line.FlyingMinutes = race.flyingTime(line.Arrival).Minutes()
+		if line.FlyingMinutes > 0 {
+			line.SpeedKPH = line.DistanceKM / (line.FlyingMinutes / 60)
+		}
+		line.OutsideRace = race.closed(line.Arrival)
+
+		// A bird is ranked once, on its earliest accepted clocking, even if
+		// an officer accepted a clocking flagged as a duplicate.
+		if i, ok := linePos[line.PigeonID]; ok {
+			if line.Arrival.Before(lines[i].Arrival) {
+				lines[i] = line
+			}
+			continue
+		}
+		linePos[line.PigeonID] = len(lines)
+		lines = append(lines, line)
+	}
+
+	penalties, err := loadRacePenalties(tx, raceID)
+	if err != nil {
+		return nil, err
+	}
+	applyPenalties(lines, penalties)
+
+	group := func(l ResultLine) int {
+		switch {
+		case l.Disqualified:
+			return 2
+		case l.OutsideRace:
+			return 1
+		}
+		return 0
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		if gi, gj := group(lines[i]), group(lines[j]); gi != gj {
+			return gi < gj
+		}
+		return lines[i].SpeedKPH > lines[j].SpeedKPH
+	})
+	for i := range lines {
+		if group(lines[i]) == 0 {
+			lines[i].Rank = i + 1
+		}
+	}
+	applyPointPenalties(lines, penalties)
+
+	prizes, err := computePrizeList(tx, race)
+	if err != nil {
+		return nil, err
+	}
+	applyPrizes(lines, prizes)
+	return lines, nil
+}
+
+// storeRaceResults replaces the stored RaceResults of a race.
+func storeRaceResults(tx *sql.Tx, raceID int, lines []ResultLine) error {
+	if _, err := tx.Exec(`DELETE FROM RaceResults WHERE race_id = $1`, raceID); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		var rank interface{}
+		if l.Rank > 0 {
+			rank = l.Rank
+		}
+		_, err := tx.Exec(`
+			INSERT INTO RaceResults (race_id, pigeon_id, user_id, distance_km, speed_kph, arrival_time, rank, outside_race, prize, prize_amount,
+				disqualified, penalty_minutes, penalty_points, loft_penalty_points, penalty_codes)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+			raceID, l.PigeonID, l.UserID, l.DistanceKM, l.SpeedKPH, l.Arrival, rank, l.OutsideRace, l.Prize, l.PrizeAmount,
+			l.Disqualified, l.PenaltyMinutes, l.PenaltyPoints, l.LoftPenalty, strings.Join(l.Penalties, ","))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ComputeRaceResultsHandler recomputes the ranking of a race and stores it
+// as a new provisional revision, recording who ran it and why. The public
+// results only change when a revision is published.
+func ComputeRaceResultsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		var input struct {
+			UserID int    `json:"user_id"`
+			Reason string `json:"reason"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.UserID == 0 || input.Reason == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "user_id and reason are required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		rev, err := recomputeRaceResults(tx, raceID, input.Reason, &input.UserID, nil)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Provisional results computed", "revision_no": rev.RevisionNo, "results": rev.Results, "teams": rev.Teams})
+	}
+}
+
+// loadStoredResults reads the official ranking of a race.
+func loadStoredResults(q queryer, raceID int) ([]ResultLine, error) {
+	rows, err := q.Query(`
+		SELECT COALESCE(rr.rank, 0), rr.pigeon_id, p.ring_number, u.user_id, COALESCE(u.full_name, u.username),
+			rr.arrival_time, COALESCE(rr.distance_km, 0), rr.speed_kph, rr.outside_race, rr.prize, rr.prize_amount,
+			rr.disqualified, rr.penalty_minutes, rr.penalty_points, rr.loft_penalty_points, rr.penalty_codes, l.latitude, l.longitude
+		FROM RaceResults rr
+		JOIN Pigeons p ON p.pigeon_id = rr.pigeon_id
+		JOIN Users u ON u.user_id = COALESCE(rr.user_id, p.user_id)
+		LEFT JOIN LoftCoordinates l ON l.user_id = u.user_id
+		WHERE rr.race_id = $1
+		ORDER BY rr.disqualified, rr.outside_race, rr.rank
+	`, raceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []ResultLine{}
+	for rows.Next() {
+		var l ResultLine
+		var codes string
+		err := rows.Scan(&l.Rank, &l.PigeonID, &l.RingNumber, &l.UserID, &l.Fancier, &l.Arrival, &l.DistanceKM,
+			&l.SpeedKPH, &l.OutsideRace, &l.Prize, &l.PrizeAmount,
+			&l.Disqualified, &l.PenaltyMinutes, &l.PenaltyPoints, &l.LoftPenalty, &codes, &l.LoftLat, &l.LoftLng)
+		if err != nil {
+			return nil, err
+		}
+		if codes != "" {
+			l.Penalties = strings.Split(codes, ",")
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
+
+// GetRaceResultsHandler returns the stored ranking of a race as JSON, or as
+// a downloadable result sheet with ?format=csv|xlsx|pdf.
+func GetRaceResultsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+
+		format := c.Query("format", "json")
+		if format == "json" {
+			lines, err := loadStoredResults(db, raceID)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			return c.JSON(lines)
+		}
+		if format != "csv" && format != "xlsx" && format != "pdf" {
+			return c.Status(400).JSON(fiber.Map{"error": "format must be json, csv, xlsx or pdf"})
+		}
+
+		sheet, err := loadResultSheet(db, raceID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		body, contentType, err := exportResults(sheet, format)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		c.Set(fiber.HeaderContentType, contentType)
+		c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="race-%d-results.%s"`, raceID, format))
+		return c.Send(body)
+	}
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hvm_clocking/events"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ResultRevision is one stored computation of a race's results. Revisions
+// are provisional until one is published; the published revision is copied
+// to RaceResults and TeamResults, which everything public reads from.
+type ResultRevision struct {
+	RevisionID  int          `json:"revision_id"`
+	RaceID      int          `json:"race_id"`
+	RevisionNo  int          `json:"revision_no"`
+	Reason      string       `json:"reason"`
+	CreatedBy   *int         `json:"created_by"`
+	ProtestID   *int         `json:"protest_id"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Official    bool         `json:"official"`
+	PublishedBy *int         `json:"published_by"`
+	PublishedAt *time.Time   `json:"published_at"`
+	Results     []ResultLine `json:"results"`
+	Teams       []TeamResult `json:"teams"`
+}
+
+var errNoRevision = errors.New("no such result revision")
+
+// saveResultRevision stores lines and teams as the next revision of a race.
+func saveResultRevision(tx *sql.Tx, rev ResultRevision) (ResultRevision, error) {
+	if rev.Results == nil {
+		rev.Results = []ResultLine{}
+	}
+	if rev.Teams == nil {
+		rev.Teams = []TeamResult{}
+	}
+	results, _ := json.Marshal(rev.Results)
+	teams, _ := json.Marshal(rev.Teams)
+	err := tx.QueryRow(`
+		INSERT INTO ResultRevisions (race_id, revision_no, reason, created_by, protest_id, results, teams)
+		VALUES ($1, (SELECT COALESCE(MAX(revision_no), 0) + 1 FROM ResultRevisions WHERE race_id = $1), $2, $3, $4, $5, $6)
+		RETURNING revision_id, revision_no, created_at`,
+		rev.RaceID, rev.Reason, rev.CreatedBy, rev.ProtestID, results, teams).Scan(&rev.RevisionID, &rev.RevisionNo, &rev.CreatedAt)
+	return rev, err
+}
+
+// recomputeRaceResults computes the results and team results of a race and
+// keeps them as a new provisional revision.
+func recomputeRaceResults(tx *sql.Tx, raceID int, reason string, createdBy, protestID *int) (ResultRevision, error) {
+	rev := ResultRevision{RaceID: raceID, Reason: reason, CreatedBy: createdBy, ProtestID: protestID}
+
+	lines, err := computeRaceResults(tx, raceID)
+	if err != nil {
+		return rev, err
+	}
+	race, err := loadRaceInfo(tx, raceID)
+	if err != nil {
+		return rev, err
+	}
+	teams, err := computeTeamResults(tx, race, lines)
+	if err != nil {
+		return rev, err
+	}
+	rev.Results, rev.Teams = lines, teams
+	return saveResultRevision(tx, rev)
+}
+
+// publishResultRevision makes a revision the official result of its race and
+// publishes ResultsOfficial.
+func publishResultRevision(tx *sql.Tx, raceID, revisionNo, publishedBy int) (ResultRevision, error) {
+	rev, err := loadResultRevision(tx, raceID, revisionNo)
+	if err != nil {
+		return rev, err
+	}
+	if err := storeRaceResults(tx, raceID, rev.Results); err != nil {
+		return rev, err
+	}
+	if err := storeTeamResults(tx, raceID, rev.Teams); err != nil {
+		return rev, err
+	}
+
+	if _, err := tx.Exec(`UPDATE ResultRevisions SET official = FALSE WHERE race_id = $1 AND official`, raceID); err != nil {
+		return rev, err
+	}
+	err = tx.QueryRow(`
+		UPDATE ResultRevisions SET official = TRUE, published_by = $1, published_at = NOW()
+		WHERE revision_id = $2
+		RETURNING published_at`, publishedBy, rev.RevisionID).Scan(&rev.PublishedAt)
+	if err != nil {
+		return rev, err
+	}
+	rev.Official, rev.PublishedBy = true, &publishedBy
+
+	err = events.Publish(tx, events.ResultsOfficial, events.ResultsOfficialPayload{RaceID: raceID, RevisionNo: revisionNo})
+	return rev, err
+}
+
+const revisionColumns = `revision_id, race_id, revision_no, reason, created_by, protest_id, created_at,
+	official, published_by, published_at, results, teams`
+
+func scanResultRevision(row interface{ Scan(...interface{}) error }) (ResultRevision, error) {
+	var r ResultRevision
+	var createdBy, protestID, publishedBy sql.NullInt64
+	var publishedAt sql.NullTime
+	var results, teams []byte
+	err := row.Scan(&r.RevisionID, &r.RaceID, &r.RevisionNo, &r.Reason, &createdBy, &protestID, &r.CreatedAt,
+		&r.Official, &publishedBy, &publishedAt, &results, &teams)
+	if err != nil {
+		return r, err
+	}
+	r.CreatedBy = nullIntPtr(createdBy)
+	r.ProtestID = nullIntPtr(protestID)
+	r.PublishedBy = nullIntPtr(publishedBy)
+	if publishedAt.Valid {
+		r.PublishedAt = &publishedAt.Time
+	}
+	if err := json.Unmarshal(results, &r.Results); err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(teams, &r.Teams)
+	return r, err
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+func loadResultRevision(q queryer, raceID, revisionNo int) (ResultRevision, error) {
+	rev, err := scanResultRevision(q.QueryRow(`SELECT `+revisionColumns+`
+		FROM ResultRevisions WHERE race_id = $1 AND revision_no = $2`, raceID, revisionNo))
+	if err == sql.ErrNoRows {
+		err = errNoRevision
+	}
+	return rev, err
+}
+
+func loadResultRevisions(q queryer, raceID int) ([]ResultRevision, error) {
+	rows, err := q.Query(`SELECT `+revisionColumns+`
+		FROM ResultRevisions WHERE race_id = $1
+		ORDER BY revision_no`, raceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ResultRevision{}
+	for rows.Next() {
+		r, err := scanResultRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// RevisionChange is how one bird's result line differs between two revisions.
+type RevisionChange struct {
+	PigeonID   int         `json:"pigeon_id"`
+	RingNumber string      `json:"ring_number"`
+	Change     string      `json:"change"` // added | removed | changed
+	From       *ResultLine `json:"from,omitempty"`
+	To         *ResultLine `json:"to,omitempty"`
+	Fields     []string    `json:"fields,omitempty"`
+}
+
+// diffRevisions compares two result revisions bird by bird.
+func diffRevisions(from, to ResultRevision) []RevisionChange {
+	before := map[int]ResultLine{}
+	for _, l := range from.Results {
+		before[l.PigeonID] = l
+	}
+
+	changes := []RevisionChange{}
+	seen := map[int]bool{}
+	for _, l := range to.Results {
+		l := l
+		seen[l.PigeonID] = true
+		old, ok := before[l.PigeonID]
+		if !ok {
+			changes = append(changes, RevisionChange{PigeonID: l.PigeonID, RingNumber: l.RingNumber, Change: "added", To: &l})
+			continue
+		}
+		var fields []string
+		if old.Rank != l.Rank {
+			fields = append(fields, "rank")
+		}
+		if !old.Arrival.Equal(l.Arrival) {
+			fields = append(fields, "arrival_time")
+		}
+		if math.Abs(old.SpeedKPH-l.SpeedKPH) > 1e-6 {
+			fields = append(fields, "speed_kph")
+		}
+		if math.Abs(old.DistanceKM-l.DistanceKM) > 1e-6 {
+			fields = append(fields, "distance_km")
+		}
+		if old.OutsideRace != l.OutsideRace {
+			fields = append(fields, "outside_race")
+		}
+		if old.Disqualified != l.Disqualified {
+			fields = append(fields, "disqualified")
+		}
+		if math.Abs(old.PenaltyMinutes-l.PenaltyMinutes) > 1e-6 {
+			fields = append(fields, "penalty_minutes")
+		}
+		if math.Abs(old.PenaltyPoints-l.PenaltyPoints) > 1e-6 {
+			fields = append(fields, "penalty_points")
+		}
+		if math.Abs(old.LoftPenalty-l.LoftPenalty) > 1e-6 {
+			fields = append(fields, "loft_penalty_points")
+		}
+		if strings.Join(old.Penalties, ",") != strings.Join(l.Penalties, ",") {
+			fields = append(fields, "penalties")
+		}
+		if old.Prize != l.Prize || old.PrizeAmount != l.PrizeAmount {
+			fields = append(fields, "prize")
+		}
+		if len(fields) > 0 {
+			changes = append(changes, RevisionChange{PigeonID: l.PigeonID, RingNumber: l.RingNumber, Change: "changed", From: &old, To: &l, Fields: fields})
+		}
+	}
+	for _, l := range from.Results {
+		l := l
+		if !seen[l.PigeonID] {
+			changes = append(changes, RevisionChange{PigeonID: l.PigeonID, RingNumber: l.RingNumber, Change: "removed", From: &l})
+		}
+	}
+	return changes
+}
+
+// =========================== RESULT REVISIONS ===========================
+
+// GetResultRevisionsHandler returns every stored result revision of a race,
+// oldest first.
+func GetResultRevisionsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		revisions, err := loadResultRevisions(db, raceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(revisions)
+	}
+}
+
+// GetResultRevisionHandler returns one result revision of a race.
+func GetResultRevisionHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err1 := strconv.Atoi(c.Params("id"))
+		revisionNo, err2 := strconv.Atoi(c.Params("no"))
+		if err1 != nil || err2 != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id or revision number"})
+		}
+		rev, err := loadResultRevision(db, raceID, revisionNo)
+		if err == errNoRevision {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(rev)
+	}
+}
+
+// DiffResultRevisionsHandler compares two revisions of a race given as
+// ?from=N&to=M. Without to, the latest revision is used.
+func DiffResultRevisionsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		fromNo, err := strconv.Atoi(c.Query("from"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "from must be a revision number"})
+		}
+		toNo := c.QueryInt("to")
+		if toNo == 0 {
+			if err := db.QueryRow(`SELECT COALESCE(MAX(revision_no), 0) FROM ResultRevisions WHERE race_id = $1`, raceID).Scan(&toNo); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		from, err := loadResultRevision(db, raceID, fromNo)
+		if err == nil {
+			var to ResultRevision
+			to, err = loadResultRevision(db, raceID, toNo)
+			if err == nil {
+				return c.JSON(fiber.Map{"from": fromNo, "to": toNo, "changes": diffRevisions(from, to)})
+			}
+		}
+		if err == errNoRevision {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+}
+
+// PublishResultRevisionHandler freezes a revision as the official result
+// shown to the public.
+func PublishResultRevisionHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err1 := strconv.Atoi(c.Params("id"))
+		revisionNo, err2 := strconv.Atoi(c.Params("no"))
+		if err1 != nil || err2 != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id or revision number"})
+		}
+		var input struct {
+			PublishedBy int `json:"published_by"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		ok, err := isClubOfficer(tx, input.PublishedBy)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ok {
+			return c.Status(403).JSON(fiber.Map{"error": "Only club officers can publish results"})
+		}
+
+		rev, err := publishResultRevision(tx, raceID, revisionNo, input.PublishedBy)
+		if err == errNoRevision {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Results published as official", "revision_no": rev.RevisionNo})
+	}
+}
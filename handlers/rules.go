@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Clocking statuses
+const (
+	ClockingAccepted    = "accepted"
+	ClockingQuarantined = "quarantined"
+	ClockingRejected    = "rejected"
+	ClockingUnverified  = "unverified"  // manual clocking awaiting an officer
+	ClockingInvalidated = "invalidated" // race cancelled, postponed or re-released
+)
+
+// Clocking sources
+const (
+	SourceDevice = "device"
+	SourceManual = "manual" // mechanical clock or phoned-in arrival
+)
+
+// Finding is one anomaly a rule detected on a clocking.
+type Finding struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+// clockingCheck is everything the rules look at for one clocking.
+type clockingCheck struct {
+	ClockingID int // 0 when the clocking is not stored yet
+	PigeonID   int
+	RaceID     int
+	Arrival    time.Time
+	Race       raceInfo
+}
+
+// raceInfo holds the race fields the rules and the result engine need,
+// together with the owning club's anomaly policy.
+type raceInfo struct {
+	RaceID        int
+	Name          string
+	ReleaseTime   time.Time
+	DistanceKM    float64
+	ClubID        sql.NullInt64
+	SeasonID      sql.NullInt64
+	ReleaseLat    sql.NullFloat64
+	ReleaseLng    sql.NullFloat64
+	AnomalyAction string // reject | quarantine
+	MaxSpeedKPH   float64
+	Window        flyingWindow
+	CloseTime     sql.NullTime
+	PrizeRatio    int       // 1 in N basketed birds win a prize, 0 for no prizes
+	EntryFee      float64   // per basketed bird
+	DeductionPct  float64   // club share of the pool
+	PrizeSplit    []float64 // optional percentage of the pool per position
+	TeamSize      int       // nominated birds scored per loft team, 0 for no team result
+	TeamScoring   string    // positions | avg_speed
+	DerbyID       sql.NullInt64
+	RaceType      string // standard | hotspot | derby_final
+	Status        string // scheduled | postponed | released | cancelled
+}
+
+func loadRaceInfo(q queryer, raceID int) (raceInfo, error) {
+	r := raceInfo{RaceID: raceID}
+	var dayStart, dayEnd string
+	var prizeSplit []byte
+	err := q.QueryRow(`
+		SELECT r.name, r.release_time, COALESCE(r.distance_km, 0), r.club_id,
+			COALESCE(cl.anomaly_action, 'quarantine'), COALESCE(cl.max_speed_kph, 200),
+			r.flying_window, COALESCE(to_char(r.day_start, 'HH24:MI:SS'), ''), COALESCE(to_char(r.day_end, 'HH24:MI:SS'), ''),
+			COALESCE(r.release_lat, 0), COALESCE(r.release_lng, 0), r.close_time,
+			r.prize_ratio, r.entry_fee, r.deduction_pct, r.prize_split,
+			r.season_id, r.release_lat, r.release_lng, r.team_size, r.team_scoring,
+			r.derby_id, r.race_type, r.status
+		FROM Races r
+		LEFT JOIN Clubs cl ON cl.club_id = r.club_id
+		WHERE r.race_id = $1
+	`, raceID).Scan(&r.Name, &r.ReleaseTime, &r.DistanceKM, &r.ClubID, &r.AnomalyAction, &r.MaxSpeedKPH,
+		&r.Window.Mode, &dayStart, &dayEnd, &r.Window.Lat, &r.Window.Lng, &r.CloseTime,
+		&r.PrizeRatio, &r.EntryFee, &r.DeductionPct, &prizeSplit,
+		&r.SeasonID, &r.ReleaseLat, &r.ReleaseLng, &r.TeamSize, &r.TeamScoring,
+		&r.DerbyID, &r.RaceType, &r.Status)
+	if err != nil {
+		return r, err
+	}
+	if err := json.Unmarshal(prizeSplit, &r.PrizeSplit); err != nil {
+		return r, err
+	}
+
+	if r.Window.Mode == WindowFixed {
+		if r.Window.DayStart, err = parseClockTime(dayStart); err != nil {
+			return r, err
+		}
+		if r.Window.DayEnd, err = parseClockTime(dayEnd); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// flyingTime is the neutralized time a bird arriving at t has been flying.
+func (r raceInfo) flyingTime(t time.Time) time.Duration {
+	return flyingDuration(r.ReleaseTime, t, r.Window)
+}
+
+// distanceTo is the distance flown to a loft: measured from the release
+// point when both points are known, otherwise the race's nominal distance.
+// Derby birds are all clocked at the central loft, so they share the race distance.
+func (r raceInfo) distanceTo(loftLat, loftLng sql.NullFloat64) float64 {
+	if r.DerbyID.Valid {
+		return r.DistanceKM
+	}
+	if r.ReleaseLat.Valid && r.ReleaseLng.Valid && loftLat.Valid && loftLng.Valid {
+		return haversineKM(r.ReleaseLat.Float64, r.ReleaseLng.Float64, loftLat.Float64, loftLng.Float64)
+	}
+	return r.DistanceKM
+}
+
+// closed reports whether t is after the race closing time.
+func (r raceInfo) closed(t time.Time) bool {
+	return r.CloseTime.Valid && t.After(r.CloseTime.Time)
+}
+
+// clockingRule inspects one clocking and returns a finding, or nil if it passes.
+type clockingRule struct {
+	Name  string
+	Check func(q queryer, clk clockingCheck) (*Finding, error)
+}
+
+// clockingRules run in ClockPigeonHandler before a clocking is stored and
+// again for every clocking when race results are computed.
+var clockingRules = []clockingRule{
+	{Name: "not_entered", Check: checkNotEntered},
+	{Name: "duplicate", Check: checkDuplicate},
+	{Name: "before_release", Check: checkBeforeRelease},
+	{Name: "impossible_speed", Check: checkImpossibleSpeed},
+}
+
+func checkNotEntered(q queryer, clk clockingCheck) (*Finding, error) {
+	var entered bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM RaceParticipants WHERE race_id = $1 AND pigeon_id = $2 AND status = $3)`,
+		clk.RaceID, clk.PigeonID, EntryEntered).Scan(&entered)
+	if err != nil || entered {
+		return nil, err
+	}
+	return &Finding{Rule: "not_entered", Detail: "Pigeon is not entered in this race"}, nil
+}
+
+// checkDuplicate keeps the earliest stored clocking of a pigeon in a race and
+// flags every later one.
+func checkDuplicate(q queryer, clk clockingCheck) (*Finding, error) {
+	var firstID sql.NullInt64
+	query := `SELECT MIN(clocking_id) FROM Clockings WHERE race_id = $1 AND pigeon_id = $2 AND status NOT IN ('rejected', 'invalidated')`
+	args := []interface{}{clk.RaceID, clk.PigeonID}
+	if clk.ClockingID != 0 {
+		query += ` AND clocking_id < $3`
+		args = append(args, clk.ClockingID)
+	}
+	if err := q.QueryRow(query, args...).Scan(&firstID); err != nil || !firstID.Valid {
+		return nil, err
+	}
+	return &Finding{Rule: "duplicate", Detail: fmt.Sprintf("Pigeon was already clocked in this race (clocking %d)", firstID.Int64)}, nil
+}
+
+func checkBeforeRelease(q queryer, clk clockingCheck) (*Finding, error) {
+	if clk.Arrival.After(clk.Race.ReleaseTime) {
+		return nil, nil
+	}
+	return &Finding{Rule: "before_release", Detail: fmt.Sprintf("Arrival %s is not after release %s",
+		clk.Arrival.Format("2006-01-02 15:04:05"), clk.Race.ReleaseTime.Format("2006-01-02 15:04:05"))}, nil
+}
+
+func checkImpossibleSpeed(q queryer, clk clockingCheck) (*Finding, error) {
+	var loftLat, loftLng sql.NullFloat64
+	err := q.QueryRow(`
+		SELECT l.latitude, l.longitude
+		FROM Pigeons p
+		LEFT JOIN LoftCoordinates l ON l.user_id = pigeon_owner_at(p.pigeon_id, $2)
+		WHERE p.pigeon_id = $1
+	`, clk.PigeonID, clk.Race.ReleaseTime).Scan(&loftLat, &loftLng)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	distance := clk.Race.distanceTo(loftLat, loftLng)
+	hours := clk.Race.flyingTime(clk.Arrival).Hours()
+	if hours <= 0 || distance <= 0 {
+		return nil, nil // before_release covers the first case; no distance means nothing to compare
+	}
+	speed := distance / hours
+	if speed <= clk.Race.MaxSpeedKPH {
+		return nil, nil
+	}
+	return &Finding{Rule: "impossible_speed", Detail: fmt.Sprintf("Speed %.2f km/h exceeds the club limit of %.2f km/h", speed, clk.Race.MaxSpeedKPH)}, nil
+}
+
+// runClockingRules evaluates every rule and returns the findings together with
+// the status the club policy assigns to the clocking.
+func runClockingRules(q queryer, clk clockingCheck) ([]Finding, string, error) {
+	var findings []Finding
+	for _, rule := range clockingRules {
+		f, err := rule.Check(q, clk)
+		if err != nil {
+			return nil, "", fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		if f != nil {
+			findings = append(findings, *f)
+		}
+	}
+
+	status := ClockingAccepted
+	if len(findings) > 0 {
+		status = ClockingQuarantined
+		if clk.Race.AnomalyAction == "reject" {
+			status = ClockingRejected
+		}
+	}
+	return findings, status, nil
+}
+
+// saveFindings stores findings against a clocking. A rule that already flagged
+// the clocking is not stored twice.
+func saveFindings(q queryer, clockingID int, findings []Finding) error {
+	for _, f := range findings {
+		_, err := q.Exec(`
+			INSERT INTO ClockingFindings (clocking_id, rule, detail)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (clocking_id, rule) DO NOTHING
+		`, clockingID, f.Rule, f.Detail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
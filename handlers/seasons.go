@@ -0,0 +1,403 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Points schemes
+const (
+	PointsTable      = "table"       // points_table[position-1]
+	PointsDistance   = "distance"    // points_table[position-1] * distance_km / 100
+	PointsPrizeRatio = "prize_ratio" // max_points scaled down over the 1-in-N prize winners
+)
+
+// Standing categories
+const (
+	StandingLoft    = "loft"       // every bird of the loft scores
+	StandingFancier = "fancier"    // only the fancier's best bird in each race scores
+	StandingAce     = "ace_pigeon" // per bird
+)
+
+// pointsScheme is how a season awards championship points per race position.
+type pointsScheme struct {
+	Scheme     string
+	Table      []float64
+	PrizeRatio int
+	MaxPoints  float64
+}
+
+// points for finishing at rank in a race of distanceKM with basketed birds entered.
+func (s pointsScheme) points(rank int, distanceKM float64, basketed int) float64 {
+	if rank <= 0 {
+		return 0
+	}
+	switch s.Scheme {
+	case PointsDistance:
+		if rank > len(s.Table) {
+			return 0
+		}
+		return s.Table[rank-1] * distanceKM / 100
+	case PointsPrizeRatio:
+		if s.PrizeRatio <= 0 || basketed == 0 {
+			return 0
+		}
+		prizes := int(math.Ceil(float64(basketed) / float64(s.PrizeRatio)))
+		if rank > prizes {
+			return 0
+		}
+		return s.MaxPoints * float64(prizes-rank+1) / float64(prizes)
+	default:
+		if rank > len(s.Table) {
+			return 0
+		}
+		return s.Table[rank-1]
+	}
+}
+
+// Standing is one line of a season championship table.
+type Standing struct {
+	Rank         int     `json:"rank"`
+	SubjectID    int     `json:"subject_id"` // loft_id, user_id or pigeon_id depending on category
+	Name         string  `json:"name"`
+	Points       float64 `json:"points"`
+	RacesCounted int     `json:"races_counted"`
+}
+
+// =========================== SEASONS ===========================
+func CreateSeasonHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var s struct {
+			ClubID       *int      `json:"club_id"`
+			Name         string    `json:"name"`
+			StartDate    string    `json:"start_date"` // YYYY-MM-DD
+			EndDate      string    `json:"end_date"`   // YYYY-MM-DD
+			PointsScheme string    `json:"points_scheme"`
+			PointsTable  []float64 `json:"points_table"`
+			PrizeRatio   int       `json:"prize_ratio"`
+			MaxPoints    float64   `json:"max_points"`
+		}
+		if err := c.BodyParser(&s); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if s.Name == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+		}
+		switch s.PointsScheme {
+		case "":
+			s.PointsScheme = PointsTable
+			fallthrough
+		case PointsTable, PointsDistance:
+			if len(s.PointsTable) == 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "points_table is required for this scheme"})
+			}
+		case PointsPrizeRatio:
+			if s.PrizeRatio <= 0 || s.MaxPoints <= 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "prize_ratio and max_points are required for this scheme"})
+			}
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "points_scheme must be table, distance or prize_ratio"})
+		}
+
+		table, _ := json.Marshal(s.PointsTable)
+		var seasonID int
+		err := db.QueryRow(`
+			INSERT INTO Seasons (club_id, name, start_date, end_date, points_scheme, points_table, prize_ratio, max_points)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING season_id`,
+			s.ClubID, s.Name, nullIfEmpty(s.StartDate), nullIfEmpty(s.EndDate), s.PointsScheme, table, s.PrizeRatio, s.MaxPoints).Scan(&seasonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Season created", "season_id": seasonID})
+	}
+}
+
+func GetAllSeasonsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`
+			SELECT season_id, club_id, name, COALESCE(start_date::text, ''), COALESCE(end_date::text, ''),
+				points_scheme, points_table, prize_ratio, max_points
+			FROM Seasons ORDER BY season_id`)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		seasons := []fiber.Map{}
+		for rows.Next() {
+			var id, prizeRatio int
+			var clubID sql.NullInt64
+			var name, start, end, scheme string
+			var table json.RawMessage
+			var maxPoints float64
+			rows.Scan(&id, &clubID, &name, &start, &end, &scheme, &table, &prizeRatio, &maxPoints)
+			seasons = append(seasons, fiber.Map{
+				"season_id":     id,
+				"club_id":       clubID.Int64,
+				"name":          name,
+				"start_date":    start,
+				"end_date":      end,
+				"points_scheme": scheme,
+				"points_table":  table,
+				"prize_ratio":   prizeRatio,
+				"max_points":    maxPoints,
+			})
+		}
+		return c.JSON(seasons)
+	}
+}
+
+func loadPointsScheme(q queryer, seasonID int) (pointsScheme, error) {
+	var s pointsScheme
+	var table []byte
+	err := q.QueryRow(`SELECT points_scheme, points_table, prize_ratio, max_points FROM Seasons WHERE season_id = $1`, seasonID).
+		Scan(&s.Scheme, &table, &s.PrizeRatio, &s.MaxPoints)
+	if err != nil {
+		return s, err
+	}
+	if len(table) > 0 {
+		if err := json.Unmarshal(table, &s.Table); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// RecomputeSeasonStandings rebuilds every championship table of a season from
+// the stored RaceResults of its races.
+func RecomputeSeasonStandings(db *sql.DB, seasonID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	scheme, err := loadPointsScheme(tx, seasonID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+		SELECT rr.race_id, rr.rank, COALESCE(r.distance_km, 0),
+			(SELECT COUNT(*) FROM RaceParticipants rp WHERE rp.race_id = rr.race_id AND rp.status = 'entered'),
+			p.pigeon_id, p.ring_number, u.user_id, COALESCE(u.full_name, u.username),
+			COALESCE(l.loft_id, 0), rr.penalty_points, rr.loft_penalty_points
+		FROM RaceResults rr
+		JOIN Races r ON r.race_id = rr.race_id
+		JOIN Pigeons p ON p.pigeon_id = rr.pigeon_id
+		JOIN Users u ON u.user_id = COALESCE(rr.user_id, p.user_id)
+		LEFT JOIN LoftCoordinates l ON l.user_id = u.user_id
+		WHERE r.season_id = $1 AND rr.rank IS NOT NULL AND r.status <> 'cancelled'
+		ORDER BY rr.race_id, rr.rank
+	`, seasonID)
+	if err != nil {
+		return err
+	}
+
+	tables := map[string]map[int]*Standing{
+		StandingLoft:    {},
+		StandingFancier: {},
+		StandingAce:     {},
+	}
+	// races counted per subject, to count each race once
+	seen := map[string]map[[2]int]bool{
+		StandingLoft:    {},
+		StandingFancier: {},
+		StandingAce:     {},
+	}
+	add := func(category string, raceID, subjectID int, name string, pts float64) {
+		st, ok := tables[category][subjectID]
+		if !ok {
+			st = &Standing{SubjectID: subjectID, Name: name}
+			tables[category][subjectID] = st
+		}
+		st.Points += pts
+		key := [2]int{raceID, subjectID}
+		if !seen[category][key] {
+			seen[category][key] = true
+			st.RacesCounted++
+		}
+	}
+
+	for rows.Next() {
+		var raceID, rank, basketed, pigeonID, userID, loftID int
+		var distance, penaltyPoints, loftPenalty float64
+		var ring, fancier string
+		if err := rows.Scan(&raceID, &rank, &distance, &basketed, &pigeonID, &ring, &userID, &fancier, &loftID, &penaltyPoints, &loftPenalty); err != nil {
+			rows.Close()
+			return err
+		}
+		// A loft penalty is not the bird's: it counts against the fancier
+		// and the loft, never in the ace table.
+		pts := scheme.points(rank, distance, basketed) - penaltyPoints
+
+		add(StandingAce, raceID, pigeonID, ring, pts)
+		if loftID != 0 {
+			add(StandingLoft, raceID, loftID, fancier, pts-loftPenalty)
+		}
+		// Rows are ordered by rank, so the first bird seen is the fancier's
+		// best, the line a loft penalty is put on.
+		if !seen[StandingFancier][[2]int{raceID, userID}] {
+			add(StandingFancier, raceID, userID, fancier, pts-loftPenalty)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Point penalties on a bird or loft without a ranked line in the race are
+	// not on any result line; deduct them here. A bird penalty counts for the
+	// bird, its owner at release and their loft; a loft penalty only for the
+	// fancier and the loft.
+	rows, err = tx.Query(`
+		WITH offline AS (
+			SELECT pen.pigeon_id, COALESCE(pen.user_id, pigeon_owner_at(pen.pigeon_id, r.release_time)) AS user_id, pen.points
+			FROM Penalties pen
+			JOIN Races r ON r.race_id = pen.race_id
+			WHERE r.season_id = $1 AND r.status <> 'cancelled' AND pen.kind = $2
+				AND EXISTS (SELECT 1 FROM RaceResults rr WHERE rr.race_id = pen.race_id)
+				AND NOT EXISTS (
+					SELECT 1 FROM RaceResults rr
+					JOIN Pigeons p ON p.pigeon_id = rr.pigeon_id
+					WHERE rr.race_id = pen.race_id AND rr.rank IS NOT NULL
+						AND CASE WHEN pen.pigeon_id IS NOT NULL THEN rr.pigeon_id = pen.pigeon_id
+							ELSE COALESCE(rr.user_id, p.user_id) = pen.user_id END
+				)
+		)
+		SELECT COALESCE(o.pigeon_id, 0), COALESCE(pg.ring_number, ''), o.user_id, COALESCE(u.full_name, u.username),
+			COALESCE(l.loft_id, 0), SUM(o.points)
+		FROM offline o
+		JOIN Users u ON u.user_id = o.user_id
+		LEFT JOIN Pigeons pg ON pg.pigeon_id = o.pigeon_id
+		LEFT JOIN LoftCoordinates l ON l.user_id = u.user_id
+		GROUP BY o.pigeon_id, pg.ring_number, o.user_id, u.full_name, u.username, l.loft_id
+	`, seasonID, PenaltyPoints)
+	if err != nil {
+		return err
+	}
+	deduct := func(category string, subjectID int, name string, pts float64) {
+		st, ok := tables[category][subjectID]
+		if !ok {
+			st = &Standing{SubjectID: subjectID, Name: name}
+			tables[category][subjectID] = st
+		}
+		st.Points -= pts
+	}
+	for rows.Next() {
+		var pigeonID, userID, loftID int
+		var ring, fancier string
+		var points float64
+		if err := rows.Scan(&pigeonID, &ring, &userID, &fancier, &loftID, &points); err != nil {
+			rows.Close()
+			return err
+		}
+		if pigeonID != 0 {
+			deduct(StandingAce, pigeonID, ring, points)
+		}
+		deduct(StandingFancier, userID, fancier, points)
+		if loftID != 0 {
+			deduct(StandingLoft, loftID, fancier, points)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM SeasonStandings WHERE season_id = $1`, seasonID); err != nil {
+		return err
+	}
+	for category, subjects := range tables {
+		for i, st := range rankStandings(subjects) {
+			_, err := tx.Exec(`
+				INSERT INTO SeasonStandings (season_id, category, subject_id, name, points, races_counted, rank)
+				VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+				seasonID, category, st.SubjectID, st.Name, st.Points, st.RacesCounted, i+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func rankStandings(subjects map[int]*Standing) []*Standing {
+	list := make([]*Standing, 0, len(subjects))
+	for _, st := range subjects {
+		list = append(list, st)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Points != list[j].Points {
+			return list[i].Points > list[j].Points
+		}
+		return list[i].SubjectID < list[j].SubjectID
+	})
+	return list
+}
+
+// RecomputeSeasonStandingsForRace recomputes the standings of the season a
+// race belongs to. Races outside a season are ignored.
+func RecomputeSeasonStandingsForRace(db *sql.DB, raceID int) error {
+	var seasonID sql.NullInt64
+	if err := db.QueryRow(`SELECT season_id FROM Races WHERE race_id = $1`, raceID).Scan(&seasonID); err != nil {
+		return err
+	}
+	if !seasonID.Valid {
+		return nil
+	}
+	return RecomputeSeasonStandings(db, int(seasonID.Int64))
+}
+
+func RecomputeSeasonStandingsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		seasonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid season id"})
+		}
+		err = RecomputeSeasonStandings(db, seasonID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Season not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Season standings recomputed"})
+	}
+}
+
+func GetSeasonStandingsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		category := c.Query("category", StandingLoft)
+		if category != StandingLoft && category != StandingFancier && category != StandingAce {
+			return c.Status(400).JSON(fiber.Map{"error": "category must be loft, fancier or ace_pigeon"})
+		}
+
+		rows, err := db.Query(`
+			SELECT rank, subject_id, name, points, races_counted
+			FROM SeasonStandings
+			WHERE season_id = $1 AND category = $2
+			ORDER BY rank
+		`, c.Params("id"), category)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		standings := []Standing{}
+		for rows.Next() {
+			var st Standing
+			if err := rows.Scan(&st.Rank, &st.SubjectID, &st.Name, &st.Points, &st.RacesCounted); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			standings = append(standings, st)
+		}
+		return c.JSON(standings)
+	}
+}
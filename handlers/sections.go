@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Section kinds
+const (
+	SectionBand    = "band"    // lofts whose race distance is in [min_km, max_km)
+	SectionPolygon = "polygon" // lofts inside a polygon of [lat, lng] points
+)
+
+// Section is a part of a club's territory scored separately in a season.
+type Section struct {
+	SectionID int          `json:"section_id"`
+	SeasonID  int          `json:"season_id"`
+	Name      string       `json:"name"`
+	Kind      string       `json:"kind"`
+	MinKM     float64      `json:"min_km"`
+	MaxKM     float64      `json:"max_km"`
+	Polygon   [][2]float64 `json:"polygon"`
+}
+
+// contains reports whether a loft at lat/lng, distanceKM from the release
+// point, belongs to the section.
+func (s Section) contains(lat, lng, distanceKM float64) bool {
+	if s.Kind == SectionPolygon {
+		return pointInPolygon(lat, lng, s.Polygon)
+	}
+	return distanceKM >= s.MinKM && (s.MaxKM == 0 || distanceKM < s.MaxKM)
+}
+
+// haversineKM is the great-circle distance between two points.
+func haversineKM(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadiusKM = 6371.0
+	const rad = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKM * math.Asin(math.Sqrt(a))
+}
+
+// pointInPolygon is the ray casting test; polygon points are [lat, lng].
+func pointInPolygon(lat, lng float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		yi, xi := polygon[i][0], polygon[i][1]
+		yj, xj := polygon[j][0], polygon[j][1]
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func loadSeasonSections(q queryer, seasonID int) ([]Section, error) {
+	rows, err := q.Query(`
+		SELECT section_id, season_id, name, kind, min_km, max_km, polygon
+		FROM Sections WHERE season_id = $1
+		ORDER BY section_id
+	`, seasonID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sections := []Section{}
+	for rows.Next() {
+		var s Section
+		var polygon []byte
+		if err := rows.Scan(&s.SectionID, &s.SeasonID, &s.Name, &s.Kind, &s.MinKM, &s.MaxKM, &polygon); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(polygon, &s.Polygon); err != nil {
+			return nil, err
+		}
+		sections = append(sections, s)
+	}
+	return sections, rows.Err()
+}
+
+// =========================== SECTIONS ===========================
+func CreateSectionHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		seasonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid season id"})
+		}
+		var s Section
+		if err := c.BodyParser(&s); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if s.Name == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+		}
+		switch s.Kind {
+		case SectionBand:
+			if s.MinKM < 0 || (s.MaxKM != 0 && s.MaxKM <= s.MinKM) {
+				return c.Status(400).JSON(fiber.Map{"error": "max_km must be above min_km (0 for no upper bound)"})
+			}
+		case SectionPolygon:
+			if len(s.Polygon) < 3 {
+				return c.Status(400).JSON(fiber.Map{"error": "polygon needs at least 3 [lat, lng] points"})
+			}
+		default:
+			return c.Status(400).JSON(fiber.Map{"error": "kind must be band or polygon"})
+		}
+		if s.Polygon == nil {
+			s.Polygon = [][2]float64{}
+		}
+		polygon, _ := json.Marshal(s.Polygon)
+
+		var sectionID int
+		err = db.QueryRow(`
+			INSERT INTO Sections (season_id, name, kind, min_km, max_km, polygon)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING section_id`,
+			seasonID, s.Name, s.Kind, s.MinKM, s.MaxKM, polygon).Scan(&sectionID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"message": "Section created", "section_id": sectionID})
+	}
+}
+
+func GetSeasonSectionsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		seasonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid season id"})
+		}
+		sections, err := loadSeasonSections(db, seasonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(sections)
+	}
+}
+
+// SectionResult is the ranking of one section of a race.
+type SectionResult struct {
+	Section Section      `json:"section"`
+	Results []ResultLine `json:"results"`
+}
+
+// splitIntoSections reranks the classified lines of a race within each section
+// of the race's season. Positions inside a section follow the overall order.
+func splitIntoSections(q queryer, race raceInfo, lines []ResultLine) ([]SectionResult, error) {
+	if !race.SeasonID.Valid {
+		return []SectionResult{}, nil
+	}
+	sections, err := loadSeasonSections(q, int(race.SeasonID.Int64))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SectionResult, 0, len(sections))
+	for _, s := range sections {
+		sr := SectionResult{Section: s, Results: []ResultLine{}}
+		for _, l := range lines {
+			if l.Rank == 0 || !l.LoftLat.Valid || !l.LoftLng.Valid {
+				continue
+			}
+			if s.contains(l.LoftLat.Float64, l.LoftLng.Float64, l.DistanceKM) {
+				l.Rank = len(sr.Results) + 1
+				sr.Results = append(sr.Results, l)
+			}
+		}
+		results = append(results, sr)
+	}
+	return results, nil
+}
+
+// GetSectionResultsHandler returns the overall ranking of a race together
+// with a ranking per section.
+func GetSectionResultsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		race, err := loadRaceInfo(db, raceID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		lines, err := loadStoredResults(db, raceID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		sections, err := splitIntoSections(db, race, lines)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"overall": lines, "sections": sections})
+	}
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Team scoring methods
+const (
+	TeamByPositions = "positions" // sum of race positions, lowest wins
+	TeamByAvgSpeed  = "avg_speed" // average speed of the team birds, highest wins
+)
+
+// TeamResult is one loft's team score in a race.
+type TeamResult struct {
+	Rank        int     `json:"rank"`
+	UserID      int     `json:"user_id"`
+	LoftID      int     `json:"loft_id"`
+	Fancier     string  `json:"fancier"`
+	Score       float64 `json:"score"`
+	BirdsScored int     `json:"birds_scored"` // team birds that were classified
+}
+
+// computeTeamResults scores the first TeamSize nominated birds of every loft.
+// A nominated bird that was not classified counts as finishing one place
+// after the last classified bird (positions) or at zero speed (avg_speed).
+func computeTeamResults(q queryer, race raceInfo, lines []ResultLine) ([]TeamResult, error) {
+	if race.TeamSize <= 0 {
+		return []TeamResult{}, nil
+	}
+
+	byPigeon := map[int]ResultLine{}
+	classified := 0
+	for _, l := range lines {
+		if l.Rank > 0 {
+			byPigeon[l.PigeonID] = l
+			classified++
+		}
+	}
+
+	rows, err := q.Query(`
+		SELECT t.user_id, COALESCE(l.loft_id, 0), COALESCE(u.full_name, u.username), t.pigeon_id
+		FROM TeamNominations t
+		JOIN Users u ON u.user_id = t.user_id
+		LEFT JOIN LoftCoordinates l ON l.user_id = t.user_id
+		WHERE t.race_id = $1
+		ORDER BY t.user_id, t.nomination_order
+	`, race.RaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	teams := map[int]*TeamResult{}
+	counted := map[int]int{}
+	var order []int
+	for rows.Next() {
+		var userID, loftID, pigeonID int
+		var fancier string
+		if err := rows.Scan(&userID, &loftID, &fancier, &pigeonID); err != nil {
+			return nil, err
+		}
+		t, ok := teams[userID]
+		if !ok {
+			t = &TeamResult{UserID: userID, LoftID: loftID, Fancier: fancier}
+			teams[userID] = t
+			order = append(order, userID)
+		}
+		if counted[userID] >= race.TeamSize {
+			continue
+		}
+		counted[userID]++
+
+		l, ok := byPigeon[pigeonID]
+		if ok {
+			t.BirdsScored++
+		}
+		switch race.TeamScoring {
+		case TeamByAvgSpeed:
+			t.Score += l.SpeedKPH
+		default:
+			if ok {
+				t.Score += float64(l.Rank)
+			} else {
+				t.Score += float64(classified + 1)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]TeamResult, 0, len(order))
+	for _, userID := range order {
+		t := teams[userID]
+		// Short teams are filled up with missing birds.
+		for i := counted[userID]; i < race.TeamSize && race.TeamScoring != TeamByAvgSpeed; i++ {
+			t.Score += float64(classified + 1)
+		}
+		if race.TeamScoring == TeamByAvgSpeed {
+			t.Score = t.Score / float64(race.TeamSize)
+		}
+		results = append(results, *t)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if race.TeamScoring == TeamByAvgSpeed {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Score < results[j].Score
+	})
+	for i := range results {
+		results[i].Rank = i + 1
+	}
+	return results, nil
+}
+
+// storeTeamResults replaces the stored team results of a race.
+func storeTeamResults(tx *sql.Tx, raceID int, teams []TeamResult) error {
+	if _, err := tx.Exec(`DELETE FROM TeamResults WHERE race_id = $1`, raceID); err != nil {
+		return err
+	}
+	for _, t := range teams {
+		var loftID interface{}
+		if t.LoftID != 0 {
+			loftID = t.LoftID
+		}
+		_, err := tx.Exec(`
+			INSERT INTO TeamResults (race_id, user_id, loft_id, rank, score, birds_scored)
+			VALUES ($1, $2, $3, $4, $5, $6)`,
+			raceID, t.UserID, loftID, t.Rank, t.Score, t.BirdsScored)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NominateTeamHandler records the birds a fancier nominates, in order, as the
+// loft's team for a race. It replaces any earlier nomination; nominations
+// are locked once the race is released.
+func NominateTeamHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raceID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid race id"})
+		}
+		var input struct {
+			UserID    int   `json:"user_id"`
+			PigeonIDs []int `json:"pigeon_ids"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.UserID == 0 || len(input.PigeonIDs) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "user_id and pigeon_ids are required"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		// Lock the race row so a release cannot slip in between the check
+		// and the new nomination.
+		var status string
+		err = tx.QueryRow(`SELECT status FROM Races WHERE race_id = $1 FOR SHARE`, raceID).Scan(&status)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Race not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if status != RaceScheduled && status != RacePostponed {
+			return c.Status(409).JSON(fiber.Map{"error": "Team nominations are closed: the race is " + status})
+		}
+
+		if _, err := tx.Exec(`DELETE FROM TeamNominations WHERE race_id = $1 AND user_id = $2`, raceID, input.UserID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		for i, pigeonID := range input.PigeonIDs {
+			var ok bool
+			err := tx.QueryRow(`
+				SELECT EXISTS (
+					SELECT 1 FROM RaceParticipants rp
+					JOIN Races r ON r.race_id = rp.race_id
+					WHERE rp.race_id = $1 AND rp.pigeon_id = $2
+						AND pigeon_owner_at(rp.pigeon_id, r.release_time) = $3
+				)`, raceID, pigeonID, input.UserID).Scan(&ok)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if !ok {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Pigeon %d is not basketed for this race by user %d", pigeonID, input.UserID)})
+			}
+			_, err = tx.Exec(`INSERT INTO TeamNominations (race_id, user_id, pigeon_id, nomination_order) VALUES ($1, $2, $3, $4)`,
+				raceID, input.UserID, pigeonID, i+1)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Team nominated"})
+	}
+}
+
+// GetTeamResultsHandler returns the stored team results of a race.
+func GetTeamResultsHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rows, err := db.Query(`
+			SELECT t.rank, t.user_id, COALESCE(t.loft_id, 0), COALESCE(u.full_name, u.username), t.score, t.birds_scored
+			FROM TeamResults t
+			JOIN Users u ON u.user_id = t.user_id
+			WHERE t.race_id = $1
+			ORDER BY t.rank
+		`, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+
+		teams := []TeamResult{}
+		for rows.Next() {
+			var t TeamResult
+			if err := rows.Scan(&t.Rank, &t.UserID, &t.LoftID, &t.Fancier, &t.Score, &t.BirdsScored); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			teams = append(teams, t)
+		}
+		return c.JSON(teams)
+	}
+}
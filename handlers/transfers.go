@@ -0,0 +1,445 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Transfer statuses
+const (
+	TransferPending   = "pending"
+	TransferAccepted  = "accepted"
+	TransferDeclined  = "declined"
+	TransferCancelled = "cancelled"
+)
+
+// PigeonTransfer is a sale or gift of a pigeon from one fancier to another.
+type PigeonTransfer struct {
+	TransferID  int        `json:"transfer_id"`
+	PigeonID    int        `json:"pigeon_id"`
+	RingNumber  string     `json:"ring_number"`
+	FromUserID  int        `json:"from_user_id"`
+	FromName    string     `json:"from_name"`
+	ToUserID    int        `json:"to_user_id"`
+	ToName      string     `json:"to_name"`
+	SalePrice   *float64   `json:"sale_price"` // nil for a gift
+	Notes       string     `json:"notes"`
+	Status      string     `json:"status"`
+	InitiatedAt time.Time  `json:"initiated_at"`
+	RespondedAt *time.Time `json:"responded_at"`
+}
+
+// OwnershipPeriod is one fancier's time as owner of a pigeon.
+type OwnershipPeriod struct {
+	UserID     int        `json:"user_id"`
+	Fancier    string     `json:"fancier"`
+	OwnedFrom  *time.Time `json:"owned_from"` // nil since the bird was registered
+	OwnedUntil *time.Time `json:"owned_until"`
+	TransferID *int       `json:"transfer_id"`
+}
+
+const transferColumns = `
+	t.transfer_id, t.pigeon_id, p.ring_number, t.from_user_id, COALESCE(f.full_name, f.username),
+	t.to_user_id, COALESCE(b.full_name, b.username), t.sale_price, COALESCE(t.notes, ''), t.status,
+	t.initiated_at, t.responded_at
+	FROM PigeonTransfers t
+	JOIN Pigeons p ON p.pigeon_id = t.pigeon_id
+	JOIN Users f ON f.user_id = t.from_user_id
+	JOIN Users b ON b.user_id = t.to_user_id`
+
+func scanTransfer(row interface{ Scan(...interface{}) error }) (PigeonTransfer, error) {
+	var t PigeonTransfer
+	var price sql.NullFloat64
+	var responded sql.NullTime
+	err := row.Scan(&t.TransferID, &t.PigeonID, &t.RingNumber, &t.FromUserID, &t.FromName,
+		&t.ToUserID, &t.ToName, &price, &t.Notes, &t.Status, &t.InitiatedAt, &responded)
+	if price.Valid {
+		t.SalePrice = &price.Float64
+	}
+	if responded.Valid {
+		t.RespondedAt = &responded.Time
+	}
+	return t, err
+}
+
+func loadTransfer(q queryer, transferID int) (PigeonTransfer, error) {
+	return scanTransfer(q.QueryRow(`SELECT `+transferColumns+` WHERE t.transfer_id = $1`, transferID))
+}
+
+// loadOwnershipHistory lists the owners of a pigeon, oldest first. A bird
+// that never changed hands has a single open period for its registered owner.
+func loadOwnershipHistory(q queryer, pigeonID int) ([]OwnershipPeriod, error) {
+	rows, err := q.Query(`
+		SELECT o.user_id, COALESCE(u.full_name, u.username), o.owned_from, o.owned_until, o.transfer_id
+		FROM PigeonOwnership o
+		JOIN Users u ON u.user_id = o.user_id
+		WHERE o.pigeon_id = $1
+		UNION ALL
+		SELECT p.user_id, COALESCE(u.full_name, u.username), NULL, NULL, NULL
+		FROM Pigeons p
+		JOIN Users u ON u.user_id = p.user_id
+		WHERE p.pigeon_id = $1 AND NOT EXISTS (SELECT 1 FROM PigeonOwnership WHERE pigeon_id = $1)
+		ORDER BY 3 NULLS FIRST
+	`, pigeonID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []OwnershipPeriod{}
+	for rows.Next() {
+		var o OwnershipPeriod
+		var from, until sql.NullTime
+		var transferID sql.NullInt64
+		if err := rows.Scan(&o.UserID, &o.Fancier, &from, &until, &transferID); err != nil {
+			return nil, err
+		}
+		if from.Valid {
+			o.OwnedFrom = &from.Time
+		}
+		if until.Valid {
+			o.OwnedUntil = &until.Time
+		}
+		o.TransferID = nullIntPtr(transferID)
+		history = append(history, o)
+	}
+	return history, rows.Err()
+}
+
+// respondToTransfer locks a pending transfer for the buyer or seller to act on.
+func respondToTransfer(tx *sql.Tx, transferID int) (PigeonTransfer, error) {
+	t, err := scanTransfer(tx.QueryRow(`SELECT `+transferColumns+` WHERE t.transfer_id = $1 FOR UPDATE OF t`, transferID))
+	if err != nil {
+		return t, err
+	}
+	if t.Status != TransferPending {
+		return t, fmt.Errorf("transfer is already %s", t.Status)
+	}
+	return t, nil
+}
+
+// =========================== OWNERSHIP ===========================
+
+// InitiateTransferHandler lets the current owner offer a pigeon to another
+// fancier, as a sale when sale_price is given or otherwise as a gift. The bird
+// only changes hands once the buyer accepts.
+func InitiateTransferHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		var input struct {
+			FromUserID int      `json:"from_user_id"`
+			ToUserID   int      `json:"to_user_id"`
+			SalePrice  *float64 `json:"sale_price"`
+			Notes      string   `json:"notes"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+		if input.FromUserID == 0 || input.ToUserID == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "from_user_id and to_user_id are required"})
+		}
+		if input.FromUserID == input.ToUserID {
+			return c.Status(400).JSON(fiber.Map{"error": "A pigeon cannot be transferred to its own owner"})
+		}
+		if input.SalePrice != nil && *input.SalePrice < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "sale_price cannot be negative"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		var ownerID int
+		var ring, status string
+		err = tx.QueryRow(`SELECT user_id, ring_number, status FROM Pigeons WHERE pigeon_id = $1 FOR UPDATE`, pigeonID).Scan(&ownerID, &ring, &status)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if ownerID != input.FromUserID {
+			return c.Status(403).JSON(fiber.Map{"error": "Only the current owner can transfer this pigeon"})
+		}
+		if status == PigeonDeceased {
+			return c.Status(409).JSON(fiber.Map{"error": "A deceased pigeon cannot be transferred"})
+		}
+
+		var buyerExists, pending, paired bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM Users WHERE user_id = $2),
+				EXISTS (SELECT 1 FROM PigeonTransfers WHERE pigeon_id = $1 AND status = $3),
+				EXISTS (SELECT 1 FROM Pairings WHERE (cock_id = $1 OR hen_id = $1) AND ended_on IS NULL)
+		`, pigeonID, input.ToUserID, TransferPending).Scan(&buyerExists, &pending, &paired)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		switch {
+		case !buyerExists:
+			return c.Status(404).JSON(fiber.Map{"error": "Buyer not found"})
+		case pending:
+			return c.Status(409).JSON(fiber.Map{"error": "This pigeon already has a pending transfer"})
+		case paired:
+			return c.Status(409).JSON(fiber.Map{"error": "End the pigeon's active pairing before transferring it"})
+		}
+
+		var price interface{}
+		if input.SalePrice != nil {
+			price = roundCents(*input.SalePrice)
+		}
+		var transferID int
+		err = tx.QueryRow(`
+			INSERT INTO PigeonTransfers (pigeon_id, from_user_id, to_user_id, sale_price, notes)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING transfer_id`,
+			pigeonID, input.FromUserID, input.ToUserID, price, nullIfEmpty(input.Notes)).Scan(&transferID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		err = notifyUser(tx, input.ToUserID, "Pigeon offered to you",
+			fmt.Sprintf("Pigeon %s has been offered to you (transfer %d). Accept or decline it to complete the transfer.", ring, transferID))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Transfer initiated", "transfer_id": transferID})
+	}
+}
+
+// AcceptTransferHandler completes a transfer on the buyer's acceptance. The
+// seller's ownership ends and the buyer's begins at that moment, so results
+// of races released before it stay with the seller.
+func AcceptTransferHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		transferID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid transfer id"})
+		}
+		var input struct {
+			UserID int `json:"user_id"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		t, err := respondToTransfer(tx, transferID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Transfer not found"})
+		}
+		if err != nil {
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+		if input.UserID != t.ToUserID {
+			return c.Status(403).JSON(fiber.Map{"error": "Only the buyer can accept this transfer"})
+		}
+
+		var ownerID int
+		if err := tx.QueryRow(`SELECT user_id FROM Pigeons WHERE pigeon_id = $1 FOR UPDATE`, t.PigeonID).Scan(&ownerID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if ownerID != t.FromUserID {
+			return c.Status(409).JSON(fiber.Map{"error": "The seller no longer owns this pigeon"})
+		}
+
+		var now time.Time
+		if err := tx.QueryRow(`SELECT CURRENT_TIMESTAMP::timestamp`).Scan(&now); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		// The first transfer writes the seller's open-ended period, after
+		// which the history always has exactly one open row.
+		_, err = tx.Exec(`
+			INSERT INTO PigeonOwnership (pigeon_id, user_id)
+			SELECT $1, $2 WHERE NOT EXISTS (SELECT 1 FROM PigeonOwnership WHERE pigeon_id = $1)`,
+			t.PigeonID, t.FromUserID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if _, err := tx.Exec(`UPDATE PigeonOwnership SET owned_until = $2 WHERE pigeon_id = $1 AND owned_until IS NULL`, t.PigeonID, now); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		_, err = tx.Exec(`INSERT INTO PigeonOwnership (pigeon_id, user_id, owned_from, transfer_id) VALUES ($1, $2, $3, $4)`,
+			t.PigeonID, t.ToUserID, now, t.TransferID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if _, err := tx.Exec(`UPDATE Pigeons SET user_id = $1 WHERE pigeon_id = $2`, t.ToUserID, t.PigeonID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if _, err := tx.Exec(`UPDATE PigeonTransfers SET status = $1, responded_at = $2 WHERE transfer_id = $3`,
+			TransferAccepted, now, t.TransferID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := logAudit(tx, t.ToUserID, fmt.Sprintf("Accepted transfer %d of pigeon %s from user %d", t.TransferID, t.RingNumber, t.FromUserID)); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		err = notifyUser(tx, t.FromUserID, "Pigeon transfer accepted",
+			fmt.Sprintf("%s accepted the transfer of pigeon %s.", t.ToName, t.RingNumber))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Transfer accepted", "transfer_id": t.TransferID, "owned_from": now})
+	}
+}
+
+// closeTransferHandler ends a pending transfer without moving the pigeon:
+// the buyer declines it or the seller cancels it.
+func closeTransferHandler(db *sql.DB, status string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		transferID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid transfer id"})
+		}
+		var input struct {
+			UserID int `json:"user_id"`
+		}
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "DB transaction failed"})
+		}
+		defer tx.Rollback()
+
+		t, err := respondToTransfer(tx, transferID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Transfer not found"})
+		}
+		if err != nil {
+			return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		notify, subject, body := t.FromUserID, "Pigeon transfer declined",
+			fmt.Sprintf("%s declined the transfer of pigeon %s.", t.ToName, t.RingNumber)
+		allowed := input.UserID == t.ToUserID
+		if status == TransferCancelled {
+			notify, subject, body = t.ToUserID, "Pigeon transfer cancelled",
+				fmt.Sprintf("%s withdrew the offer of pigeon %s.", t.FromName, t.RingNumber)
+			allowed = input.UserID == t.FromUserID
+		}
+		if !allowed {
+			return c.Status(403).JSON(fiber.Map{"error": fmt.Sprintf("This transfer cannot be %s by user %d", status, input.UserID)})
+		}
+
+		if _, err := tx.Exec(`UPDATE PigeonTransfers SET status = $1, responded_at = CURRENT_TIMESTAMP WHERE transfer_id = $2`, status, t.TransferID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := notifyUser(tx, notify, subject, body); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := tx.Commit(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Commit failed"})
+		}
+		return c.JSON(fiber.Map{"message": "Transfer " + status, "transfer_id": t.TransferID})
+	}
+}
+
+// DeclineTransferHandler lets the buyer turn down a pending transfer.
+func DeclineTransferHandler(db *sql.DB) fiber.Handler {
+	return closeTransferHandler(db, TransferDeclined)
+}
+
+// CancelTransferHandler lets the seller withdraw a pending transfer.
+func CancelTransferHandler(db *sql.DB) fiber.Handler {
+	return closeTransferHandler(db, TransferCancelled)
+}
+
+// GetOwnershipHandler returns a pigeon's ownership history and its transfers.
+func GetOwnershipHandler(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		pigeonID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pigeon id"})
+		}
+		history, err := loadOwnershipHistory(db, pigeonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(history) == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "Pigeon not found"})
+		}
+
+		rows, err := db.Query(`SELECT `+transferColumns+` WHERE t.pigeon_id = $1 ORDER BY t.initiated_at DESC`, pigeonID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer rows.Close()
+		transfers := []PigeonTransfer{}
+		for rows.Next() {
+			t, err := scanTransfer(rows)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			transfers = append(transfers, t)
+		}
+		if err := rows.Err(); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"pigeon_id": pigeonID, "owners": history, "transfers": transfers})
+	}
+}
+
+// TransferCertificatePage renders a printable certificate for a completed transfer.
+func TransferCertificatePage(db *sql.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		transferID, err := strconv.Atoi(c.Params("id"))
+		if err != nil {
+			return c.Status(400).SendString("Invalid transfer id")
+		}
+		t, err := loadTransfer(db, transferID)
+		if err == sql.ErrNoRows {
+			return c.Status(404).SendString("Transfer not found")
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		if t.Status != TransferAccepted {
+			return c.Status(409).SendString("Only accepted transfers have a certificate")
+		}
+
+		var pigeon struct{ Name, Color, Sex, Breed, BirthDate string }
+		err = db.QueryRow(`
+			SELECT COALESCE(name, ''), COALESCE(color, ''), COALESCE(sex, ''), COALESCE(breed, ''),
+				COALESCE(to_char(birth_date, 'YYYY-MM-DD'), '')
+			FROM Pigeons WHERE pigeon_id = $1`, t.PigeonID).Scan(&pigeon.Name, &pigeon.Color, &pigeon.Sex, &pigeon.Breed, &pigeon.BirthDate)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		price := ""
+		if t.SalePrice != nil {
+			price = fmt.Sprintf("%.2f", *t.SalePrice)
+		}
+		return c.Render("transfer_certificate", fiber.Map{
+			"Transfer":  t,
+			"Pigeon":    pigeon,
+			"Date":      t.RespondedAt.Format(dateLayout),
+			"SalePrice": price,
+		})
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"errors"
+	"hvm_clocking/events"
 	"log"
 	"net/http"
 	"strconv"
@@ -132,6 +133,16 @@ func RegisterHandler(db *sql.DB) fiber.Handler {
 			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 		}
 
+		err = events.Publish(tx, events.UserRegistered, events.UserRegisteredPayload{
+			UserID:   userID,
+			Username: input.Username,
+		})
+		if err != nil {
+			tx.Rollback()
+			log.Println("❌ Publish UserRegistered error:", err)
+			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		}
+
 		if err := tx.Commit(); err != nil {
 			return c.Status(http.StatusInternalServerError).JSON(fiber.Map{"error": "Commit failed"})
 		}
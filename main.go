@@ -41,8 +41,12 @@
 package main
 
 import (
+	"context"
 	"hvm_clocking/config"
+	"hvm_clocking/events"
 	"hvm_clocking/handlers"
+	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/template/html/v2"
@@ -59,6 +63,49 @@ func main() {
 	db := config.InitDB()
 	defer db.Close()
 
+	// Season standings follow official race results (domain event
+	// subscribers replay missed events from the outbox on restart)
+	championship := events.NewSubscriber(config.ConnString, db, "championship")
+	championship.On(events.ResultsOfficial, func(e events.Event) error {
+		var p events.ResultsOfficialPayload
+		if err := e.Decode(&p); err != nil {
+			return err
+		}
+		return handlers.RecomputeSeasonStandingsForRace(db, p.RaceID)
+	})
+	championship.On(events.RaceCancelled, func(e events.Event) error {
+		var p events.RaceCancelledPayload
+		if err := e.Decode(&p); err != nil {
+			return err
+		}
+		return handlers.RecomputeSeasonStandingsForRace(db, p.RaceID)
+	})
+	go func() {
+		if err := championship.Run(context.Background()); err != nil {
+			log.Println("❌ Championship subscriber stopped:", err)
+		}
+	}()
+
+	// Participants hear about releases as they happen
+	notifications := events.NewSubscriber(config.ConnString, db, "notifications")
+	notifications.On(events.RaceLiberated, func(e events.Event) error {
+		var p events.RaceLiberatedPayload
+		if err := e.Decode(&p); err != nil {
+			return err
+		}
+		return handlers.NotifyRaceLiberated(db, p)
+	})
+	go func() {
+		if err := notifications.Run(context.Background()); err != nil {
+			log.Println("❌ Notifications subscriber stopped:", err)
+		}
+	}()
+
+	// Replay responses for retried POSTs carrying an Idempotency-Key
+	const idempotencyRetention = 24 * time.Hour
+	app.Use(handlers.IdempotencyMiddleware(db, idempotencyRetention))
+	go handlers.PurgeIdempotencyKeys(context.Background(), db, idempotencyRetention, time.Hour)
+
 	// Static files (CSS, JS, images)
 	app.Static("/static", "./static")
 
@@ -82,6 +129,12 @@ func main() {
 		return c.Render("register", fiber.Map{}) // register.html
 	})
 
+	// Printable reports
+	app.Get("/reports/ace-pigeons", handlers.AcePigeonReportPage(db))
+	app.Get("/reports/pools/:id", handlers.PoolSheetPage(db))
+	app.Get("/reports/pigeons/:id/pedigree", handlers.PedigreeCertificatePage(db))
+	app.Get("/reports/transfers/:id/certificate", handlers.TransferCertificatePage(db))
+
 	// Handlers
 	app.Post("/register", handlers.RegisterHandler(db))
 	app.Post("/login", handlers.LoginHandler(db))
@@ -89,6 +142,8 @@ func main() {
 	//app.Get("/users", handlers.GetAllUsers(db))
 	app.Get("/api/users", handlers.GetAllUsers(db))
 	app.Put("/api/users/:id", handlers.UpdateUser(db))
+	app.Get("/api/users/:id/notifications", handlers.GetUserNotificationsHandler(db))
+	app.Put("/api/notifications/:id/read", handlers.MarkNotificationReadHandler(db))
 
 	app.Get("/pigeons", handlers.GetAllPigeons(db))
 	app.Get("/lofts", handlers.GetAllLofts(db))
@@ -100,10 +155,86 @@ func main() {
 	app.Post("/api/devices", handlers.CreateDeviceHandler(db))
 	app.Post("/api/lofts", handlers.CreateLoftHandler(db))
 	app.Post("/api/pigeons", handlers.CreatePigeonHandler(db))
+	app.Put("/api/pigeons/:id/parents", handlers.SetPigeonParentsHandler(db))
+	app.Get("/api/pigeons/:id/pedigree", handlers.GetPedigreeHandler(db))
+	app.Post("/api/pigeons/:id/health", handlers.AddHealthRecordHandler(db))
+	app.Get("/api/pigeons/:id/health", handlers.GetHealthRecordsHandler(db))
+	app.Get("/api/pigeons/:id/vaccination-status", handlers.GetVaccinationStatusHandler(db))
+	app.Post("/api/pigeons/:id/transfers", handlers.InitiateTransferHandler(db))
+	app.Get("/api/pigeons/:id/ownership", handlers.GetOwnershipHandler(db))
+	app.Post("/api/transfers/:id/accept", handlers.AcceptTransferHandler(db))
+	app.Post("/api/transfers/:id/decline", handlers.DeclineTransferHandler(db))
+	app.Post("/api/transfers/:id/cancel", handlers.CancelTransferHandler(db))
+	app.Put("/api/pigeons/:id/status", handlers.UpdatePigeonStatusHandler(db))
+	app.Get("/api/pigeons/:id/status-history", handlers.GetPigeonStatusHistoryHandler(db))
+	app.Get("/api/lost-pigeons", handlers.GetLostPigeonsHandler(db))
+	app.Post("/api/found-pigeons", handlers.ReportFoundPigeonHandler(db))
+
+	app.Post("/api/pairings", handlers.CreatePairingHandler(db))
+	app.Get("/api/pairings", handlers.GetPairingsHandler(db))
+	app.Get("/api/pairings/:id", handlers.GetPairingHandler(db))
+	app.Put("/api/pairings/:id/end", handlers.EndPairingHandler(db))
+	app.Post("/api/pairings/:id/rounds", handlers.AddNestRoundHandler(db))
+	app.Put("/api/nest-rounds/:id/hatch", handlers.RecordHatchHandler(db))
+	app.Post("/api/nest-rounds/:id/youngsters", handlers.RingYoungsterHandler(db))
+
 	app.Post("/api/races", handlers.CreateRaceHandler(db))
 	app.Post("/api/race-participants", handlers.RegisterPigeonToRaceHandler(db))
 	app.Post("/api/clockings", handlers.ClockPigeonHandler(db))
+	app.Post("/api/devices/:id/sync", handlers.SyncClockingsHandler(db))
+	app.Get("/api/devices/:id/sync", handlers.GetDeviceSyncStateHandler(db))
+	app.Get("/api/clockings/:id/findings", handlers.GetClockingFindingsHandler(db))
+	app.Put("/api/clockings/:id/review", handlers.ReviewClockingHandler(db))
+	app.Put("/api/clockings/:id/verify", handlers.VerifyClockingHandler(db))
+	app.Get("/api/races/:id/clockings/unverified", handlers.GetUnverifiedClockingsHandler(db))
+	app.Get("/api/readout-formats", handlers.ReadoutFormatsHandler())
+	app.Post("/api/races/:id/readouts/preview", handlers.ImportReadoutHandler(db, false))
+	app.Post("/api/races/:id/readouts/import", handlers.ImportReadoutHandler(db, true))
 	app.Post("/api/race-results", handlers.InsertRaceResultHandler(db))
+	app.Post("/api/races/:id/cancel", handlers.CancelRaceHandler(db))
+	app.Post("/api/races/:id/postpone", handlers.PostponeRaceHandler(db))
+	app.Post("/api/races/:id/re-release", handlers.ReReleaseRaceHandler(db))
+	app.Post("/api/races/:id/liberation", handlers.SubmitLiberationReportHandler(db))
+	app.Get("/api/races/:id/liberation", handlers.GetLiberationHandler(db))
+	app.Post("/api/races/:id/missing", handlers.MarkMissingHandler(db))
+	app.Post("/api/races/:id/results/compute", handlers.ComputeRaceResultsHandler(db))
+	app.Get("/api/races/:id/results", handlers.GetRaceResultsHandler(db))
+	app.Get("/api/races/:id/results/revisions", handlers.GetResultRevisionsHandler(db))
+	app.Get("/api/races/:id/results/revisions/diff", handlers.DiffResultRevisionsHandler(db))
+	app.Get("/api/races/:id/results/revisions/:no", handlers.GetResultRevisionHandler(db))
+	app.Post("/api/races/:id/results/revisions/:no/publish", handlers.PublishResultRevisionHandler(db))
+	app.Get("/api/penalty-reasons", handlers.GetPenaltyReasonsHandler())
+	app.Post("/api/races/:id/penalties", handlers.AddPenaltyHandler(db))
+	app.Get("/api/races/:id/penalties", handlers.GetRacePenaltiesHandler(db))
+	app.Delete("/api/penalties/:id", handlers.LiftPenaltyHandler(db))
+	app.Post("/api/races/:id/protests", handlers.FileProtestHandler(db))
+	app.Get("/api/races/:id/protests", handlers.GetRaceProtestsHandler(db))
+	app.Get("/api/protests/:id", handlers.GetProtestHandler(db))
+	app.Post("/api/protests/:id/evidence", handlers.AddProtestEvidenceHandler(db))
+	app.Post("/api/protests/:id/decision", handlers.DecideProtestHandler(db))
+	app.Get("/api/races/:id/results/sections", handlers.GetSectionResultsHandler(db))
+	app.Get("/api/races/:id/results/teams", handlers.GetTeamResultsHandler(db))
+	app.Post("/api/races/:id/team-nominations", handlers.NominateTeamHandler(db))
+	app.Get("/api/races/:id/prizes", handlers.GetRacePrizesHandler(db))
+	app.Post("/api/races/:id/sponsors", handlers.AddRaceSponsorHandler(db))
+	app.Post("/api/races/:id/pools", handlers.CreatePoolHandler(db))
+	app.Get("/api/pools/:id", handlers.GetPoolHandler(db))
+	app.Post("/api/pools/:id/nominations", handlers.NominatePoolHandler(db))
+	app.Post("/api/pools/:id/settle", handlers.SettlePoolHandler(db))
+	app.Post("/api/seasons", handlers.CreateSeasonHandler(db))
+	app.Get("/api/seasons", handlers.GetAllSeasonsHandler(db))
+	app.Get("/api/seasons/:id/standings", handlers.GetSeasonStandingsHandler(db))
+	app.Post("/api/seasons/:id/standings/recompute", handlers.RecomputeSeasonStandingsHandler(db))
+	app.Post("/api/seasons/:id/sections", handlers.CreateSectionHandler(db))
+	app.Get("/api/seasons/:id/sections", handlers.GetSeasonSectionsHandler(db))
+
+	app.Post("/api/derbies", handlers.CreateDerbyHandler(db))
+	app.Get("/api/derbies/:id", handlers.GetDerbyHandler(db))
+	app.Post("/api/derbies/:id/entries", handlers.AddDerbyEntryHandler(db))
+	app.Post("/api/derbies/:id/distribute", handlers.DistributeDerbyPrizesHandler(db))
+
+	app.Get("/api/ace-pigeons", handlers.GetAcePigeonsHandler(db))
+
 	app.Post("/api/audit-logs", handlers.LogAuditActionHandler(db))
 
 	app.Listen(":2000")
@@ -0,0 +1,100 @@
+package readout
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strings"
+)
+
+func init() {
+	Register("csv", csvParser{})
+}
+
+// csvParser reads a comma or semicolon separated export with a header row.
+// Recognised columns (case-insensitive): ring / ring_number, chip /
+// chip_number, arrival / arrival_time, or separate date and time columns.
+type csvParser struct{}
+
+func (csvParser) Parse(r io.Reader) ([]Record, []LineError, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	text := string(data)
+
+	cr := csv.NewReader(strings.NewReader(text))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	if firstLine, _, _ := strings.Cut(text, "\n"); strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		cr.Comma = ';'
+	}
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, errors.New("readout has no header row")
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	find := func(names ...string) int {
+		for _, n := range names {
+			if i, ok := col[n]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+	ringCol := find("ring", "ring_number", "ring number")
+	chipCol := find("chip", "chip_number", "chip number")
+	arrivalCol := find("arrival", "arrival_time", "arrival time")
+	dateCol, timeCol := find("date"), find("time")
+	if ringCol < 0 && chipCol < 0 {
+		return nil, nil, errors.New("readout needs a ring or chip column")
+	}
+	if arrivalCol < 0 && (dateCol < 0 || timeCol < 0) {
+		return nil, nil, errors.New("readout needs an arrival column or date and time columns")
+	}
+
+	field := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var records []Record
+	var lineErrs []LineError
+	line := 1
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		raw := strings.Join(row, string(cr.Comma))
+		if err != nil {
+			lineErrs = append(lineErrs, LineError{Line: line, Raw: raw, Error: err.Error()})
+			continue
+		}
+
+		arrival := field(row, arrivalCol)
+		if arrivalCol < 0 {
+			arrival = field(row, dateCol) + " " + field(row, timeCol)
+		}
+		t, err := parseArrival(arrival)
+		if err != nil {
+			lineErrs = append(lineErrs, LineError{Line: line, Raw: raw, Error: err.Error()})
+			continue
+		}
+
+		rec := Record{Line: line, RingNumber: field(row, ringCol), ChipNumber: field(row, chipCol), Arrival: t, Raw: raw}
+		if rec.RingNumber == "" && rec.ChipNumber == "" {
+			lineErrs = append(lineErrs, LineError{Line: line, Raw: raw, Error: "no ring or chip number"})
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, lineErrs, nil
+}
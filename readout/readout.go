@@ -0,0 +1,81 @@
+// Package readout parses the files electronic clocking systems produce after
+// a race. Each clock export format is a Parser registered under a name.
+package readout
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Record is one arrival read from a clock export.
+type Record struct {
+	Line       int       `json:"line"`
+	RingNumber string    `json:"ring_number,omitempty"`
+	ChipNumber string    `json:"chip_number,omitempty"`
+	Arrival    time.Time `json:"arrival_time"`
+	Raw        string    `json:"raw"`
+}
+
+// Parser reads every arrival in a clock export. Lines it cannot understand
+// are returned as errors with their line number rather than aborting.
+type Parser interface {
+	Parse(r io.Reader) ([]Record, []LineError, error)
+}
+
+// LineError is a readout line that could not be parsed.
+type LineError struct {
+	Line  int    `json:"line"`
+	Raw   string `json:"raw"`
+	Error string `json:"error"`
+}
+
+var parsers = map[string]Parser{}
+
+// Register makes a parser available under name. It panics on duplicates, like
+// database/sql.Register.
+func Register(name string, p Parser) {
+	if _, dup := parsers[name]; dup {
+		panic("readout: Register called twice for parser " + name)
+	}
+	parsers[name] = p
+}
+
+// Get returns the parser registered under name.
+func Get(name string) (Parser, error) {
+	p, ok := parsers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown readout format %q (available: %s)", name, strings.Join(Formats(), ", "))
+	}
+	return p, nil
+}
+
+// Formats lists the registered parser names.
+func Formats() []string {
+	names := make([]string, 0, len(parsers))
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// arrivalLayouts are the timestamp formats the built-in parsers accept.
+var arrivalLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"02/01/2006 15:04:05",
+	"02.01.2006 15:04:05",
+}
+
+func parseArrival(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range arrivalLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised arrival time %q", s)
+}
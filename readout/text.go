@@ -0,0 +1,48 @@
+package readout
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	Register("text", textParser{})
+}
+
+// textParser reads a printed clock readout: one arrival per line with the
+// ring or chip number followed by the arrival date and time, e.g.
+//
+//	001  PH2024-001  2025-06-10 06:35:00
+//	002  PH2024-002  10.06.2025 06:40:12
+//
+// A leading sequence number is optional. Headers, separators and any other
+// line without a timestamp are skipped.
+type textParser struct{}
+
+var textLine = regexp.MustCompile(`^(?:\d+\s+)?(\S+)\s+(\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}|\d{2}[./]\d{2}[./]\d{4} \d{2}:\d{2}:\d{2})\s*$`)
+
+func (textParser) Parse(r io.Reader) ([]Record, []LineError, error) {
+	var records []Record
+	var lineErrs []LineError
+
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		raw := strings.TrimSpace(sc.Text())
+		m := textLine.FindStringSubmatch(raw)
+		if m == nil {
+			continue
+		}
+		t, err := parseArrival(m[2])
+		if err != nil {
+			lineErrs = append(lineErrs, LineError{Line: line, Raw: raw, Error: err.Error()})
+			continue
+		}
+		// The identifier is matched against both ring and chip numbers.
+		records = append(records, Record{Line: line, RingNumber: m[1], ChipNumber: m[1], Arrival: t, Raw: raw})
+	}
+	return records, lineErrs, sc.Err()
+}